@@ -1,90 +1,191 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"github.com/ahoy-cli/ahoy/config"
 	"github.com/codegangsta/cli"
-	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
-	"sort"
+	"regexp"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
+	"time"
 )
 
-// Config handles the overall configuration in an ahoy.yml file
-// with one Config per file.
-type Config struct {
-	Usage      string
-	AhoyAPI    string
-	Commands   map[string]Command
-	Entrypoint []string
-}
+// Config is an ahoy.yml file, as loaded by the config package.
+type Config = config.Config
 
-// Command is an ahoy command detailed in ahoy.yml files. Multiple
-// commands can be defined per ahoy.yml file.
-type Command struct {
-	Description string
-	Usage       string
-	Cmd         string
-	Hide        bool
-	Imports     []string
-}
+// Command is a single command from an ahoy.yml file.
+type Command = config.Command
+
+// exitUnsupportedAPI is the exit code when a config file's ahoyapi isn't
+// supported, so that tools wrapping ahoy can tell it apart from other errors.
+const exitUnsupportedAPI = 3
+
+// exitShellNotFound is the exit code when a command's shell isn't installed,
+// the same code shells use for commands that can't be found.
+const exitShellNotFound = 127
 
 var app *cli.App
 var sourcefile string
+var sourcefiles cli.StringSlice
+var envOverrides cli.StringSlice
+var commandsFrom cli.StringSlice
 var args []string
 var verbose bool
+var noGlobal bool
+var importBase string
+var noDefaultCommands bool
+var errexit bool
+var noLocal bool
+var printConfigPath bool
+var timeCommands bool
+var explain bool
+var dumpEnvironment bool
+var prefixOutput bool
+var trace bool
+var force bool
+var watch bool
+var batch bool
+var keepGoing bool
+var assumeYes bool
+var listHidden bool
+var skipSetup bool
+var outputJSON bool
+var workingDir string
+var logLevel string
+var logFormat string
 var bashCompletion bool
 
-//The build version can be set using the go linker flag `-ldflags "-X main.version=$VERSION"`
-//Complete command: `go build -ldflags "-X main.version=$VERSION"`
+// The build version can be set using the go linker flag `-ldflags "-X main.version=$VERSION"`
+// Complete command: `go build -ldflags "-X main.version=$VERSION"`
 var version string
 
 // AhoyConf stores the global config.
 var AhoyConf struct {
 	srcDir  string
 	srcFile string
+	// commands are all of the resolved commands, so that commands can run
+	// other commands by name.
+	commands []config.ResolvedCommand
+	// defaultCommand is run when ahoy is given no command.
+	defaultCommand string
+	// setupCommand is run once, before the first command run from the ahoy
+	// file's directory.
+	setupCommand string
+	// auditLog is the ahoy file's audit_log.
+	auditLog string
+	// maskEnv matches the names of environment variables whose values are
+	// masked in ahoy's own output.
+	maskEnv []*regexp.Regexp
+}
+
+// logLevels orders the logger levels from most to least verbose.
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+	"fatal": 4,
+}
+
+// logEntry is a single log message when using the json log format.
+type logEntry struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Time    string `json:"time"`
 }
 
 func logger(errType string, text string) {
-	errText := ""
 	// Disable the flags which add date and time for instance.
 	log.SetFlags(0)
-	if errType != "debug" {
-		errText = "[" + errType + "] " + text + "\n"
-		log.Println(errText)
+	if logLevels[errType] >= logLevels[getLogLevel()] {
+		if logFormat == "json" {
+			entry, _ := json.Marshal(logEntry{
+				Level:   errType,
+				Message: text,
+				Time:    time.Now().Format(time.RFC3339),
+			})
+			log.Println(string(entry))
+		} else {
+			errText := "[" + errType + "] " + text + "\n"
+			log.Println(errText)
+		}
 	}
 
 	if errType == "fatal" {
-		os.Exit(1)
+		exit(1)
+	}
+}
+
+// getLogLevel returns the minimum level that gets logged. --verbose always
+// means debug, to stay compatible with how it worked before --log-level.
+func getLogLevel() string {
+	if verbose {
+		return "debug"
 	}
+	if _, ok := logLevels[logLevel]; ok {
+		return logLevel
+	}
+	return "info"
 }
 
 func getConfigPath(sourcefile string) (string, error) {
+	// Paths that didn't go through a shell, like quoted ones, can still use
+	// ~ and $HOME.
+	sourcefile = config.ExpandPath(sourcefile)
 	var err error
-	var config = ""
+	var configPath = ""
+
+	// A source file of "-" means the config is piped in on stdin.
+	if sourcefile == "-" {
+		return sourcefile, nil
+	}
 
 	// If a specific source file was set, then try to load it directly.
+	// A directory is searched for a .ahoy.yml file.
 	if sourcefile != "" {
-		if _, err := os.Stat(sourcefile); err == nil {
-			return sourcefile, err
+		info, err := os.Stat(sourcefile)
+		if err == nil {
+			if !info.IsDir() {
+				logger("debug", "Using the ahoy file given with -f at "+sourcefile)
+				return sourcefile, err
+			}
+			ymlpath := filepath.Join(sourcefile, ".ahoy.yml")
+			if _, err := os.Stat(ymlpath); err == nil {
+				logger("debug", "Using the .ahoy.yml in the directory given with -f at "+ymlpath)
+				return ymlpath, err
+			}
+			err = errors.New("An ahoy config directory was specified using -f to be at " + sourcefile + " but it doesn't contain a .ahoy.yml file. Check your path.")
+			return configPath, err
+		}
+		if os.IsPermission(err) {
+			err = errors.New("An ahoy config file was specified using -f to be at " + sourcefile + " but it can't be read because of its permissions. Check that you can read it.")
+			return configPath, err
 		}
 		err = errors.New("An ahoy config file was specified using -f to be at " + sourcefile + " but couldn't be found. Check your path.")
-		return config, err
+		return configPath, err
 	}
 
 	dir, err := os.Getwd()
 	if err != nil {
-		return config, err
+		return configPath, err
 	}
 	for dir != "/" && err == nil {
 		ymlpath := filepath.Join(dir, ".ahoy.yml")
-		//log.Println(ymlpath)
+		logger("debug", "Looking for .ahoy.yml in "+dir)
 		if _, err := os.Stat(ymlpath); err == nil {
 			logger("debug", "Found .ahoy.yml at "+ymlpath)
 			return ymlpath, err
@@ -97,153 +198,259 @@ func getConfigPath(sourcefile string) (string, error) {
 }
 
 func getConfig(file string) (Config, error) {
-	var config = Config{}
-	yamlFile, err := ioutil.ReadFile(file)
-	if err != nil {
-		err = errors.New("an ahoy config file couldn't be found in your path. You can create an example one by using 'ahoy init'")
-		return config, err
+	var cfg Config
+	var err error
+	// Configs read from stdin resolve imports relative to the current directory.
+	if file == "-" {
+		yamlFile, readErr := ioutil.ReadAll(os.Stdin)
+		if readErr != nil {
+			return Config{}, readErr
+		}
+		cfg, err = config.Parse(yamlFile, file)
+	} else {
+		cfg, err = config.Load(file)
 	}
-
-	// Extract the yaml file into the config varaible.
-	err = yaml.Unmarshal(yamlFile, &config)
 	if err != nil {
-		return config, err
+		return cfg, err
 	}
+	// Files can need a newer ahoy, which is checked before any command runs.
+	return cfg, config.CheckMinAhoy(cfg)
+}
 
-	// All ahoy files (and imports) must specify the ahoy version.
-	// This is so we can support backwards compatability in the future.
-	if config.AhoyAPI != "v2" {
-		err = errors.New("Ahoy only supports API version 'v2', but '" + config.AhoyAPI + "' given in " + sourcefile)
-		return config, err
+// configError exits for an error loading a config file. Unsupported API
+// versions get a single line message and their own exit code.
+func configError(err error) {
+	var apiErr *config.UnsupportedAPIError
+	if errors.As(err, &apiErr) {
+		if apiErr.Version == "" {
+			fmt.Fprintf(os.Stderr, "ahoy: config file %s is empty or missing 'ahoyapi: v2'\n", apiErr.Path)
+			exit(exitUnsupportedAPI)
+		}
+		fmt.Fprintf(os.Stderr, "ahoy: unsupported ahoyapi '%s' in %s\n", apiErr.Version, apiErr.Path)
+		exit(exitUnsupportedAPI)
 	}
+	logger("fatal", err.Error())
+}
 
-	if config.Entrypoint == nil {
-		config.Entrypoint = []string{"bash", "-c", "{{cmd}}", "{{name}}"}
+func resolveCommands(cfg Config) []config.ResolvedCommand {
+	commands, err := config.Resolve(cfg)
+	if err != nil {
+		logger("fatal", err.Error())
 	}
-
-	return config, err
+	return commands
 }
 
-func getSubCommands(includes []string) []cli.Command {
-	subCommands := []cli.Command{}
-	if 0 == len(includes) {
-		return subCommands
+// getGlobalConfigPath returns the user's global ahoy file, preferring
+// $XDG_CONFIG_HOME/ahoy/ahoy.yml over ~/.ahoy.yml, or "" if neither exists.
+func getGlobalConfigPath() string {
+	var paths []string
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		paths = append(paths, filepath.Join(xdg, "ahoy", "ahoy.yml"))
 	}
-	commands := map[string]cli.Command{}
-	for _, include := range includes {
-		if len(include) == 0 {
-			continue
-		}
-		if include[0] != "/"[0] || include[0] != "~"[0] {
-			include = filepath.Join(AhoyConf.srcDir, include)
-		}
-		if _, err := os.Stat(include); err != nil {
-			//Skipping files that cannot be loaded allows us to separate
-			//subcommands into public and private.
-			continue
-		}
-		config, _ := getConfig(include)
-		includeCommands := getCommands(config)
-		for _, command := range includeCommands {
-			commands[command.Name] = command
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".ahoy.yml"))
+	}
+	for _, globalFile := range paths {
+		if _, err := os.Stat(globalFile); err == nil {
+			return globalFile
 		}
 	}
+	return ""
+}
 
-	var names []string
-	for k := range commands {
-		names = append(names, k)
+// getGlobalCommands loads the commands from the user's global ahoy file so
+// they can be merged underneath the project's commands.
+func getGlobalCommands() []config.ResolvedCommand {
+	globalFile := getGlobalConfigPath()
+	if noGlobal || globalFile == "" {
+		return nil
+	}
+	// The global file may also be the project file when run from $HOME.
+	if srcFile, _ := filepath.Abs(AhoyConf.srcFile); srcFile == globalFile {
+		return nil
 	}
-	sort.Strings(names)
-	for _, name := range names {
-		subCommands = append(subCommands, commands[name])
+	logger("debug", "Merging global commands from "+globalFile)
+	cfg, err := getConfig(globalFile)
+	if err != nil {
+		configError(err)
 	}
-	return subCommands
+	return resolveCommands(cfg)
 }
 
-func getCommands(config Config) []cli.Command {
-	exportCmds := []cli.Command{}
-
-	var keys []string
-	for k := range config.Commands {
-		keys = append(keys, k)
+// mergeConfig merges overlay, from another -f file, .ahoy.local.yml or
+// --commands-from, on top of base. Its commands override commands with the
+// same name, and the top-level settings it sets replace base's. Its imports
+// use base's import base when --import-base is given.
+func mergeConfig(base *Config, commands []config.ResolvedCommand, overlay Config) []config.ResolvedCommand {
+	if importBase != "" {
+		overlay.ImportBase = base.ImportBase
+	}
+	commands = config.MergeCommands(commands, resolveCommands(overlay))
+	if overlay.Usage != "" {
+		base.Usage = overlay.Usage
 	}
-	sort.Strings(keys)
+	if overlay.Default != "" {
+		base.Default = overlay.Default
+	}
+	if overlay.Setup != "" {
+		base.Setup = overlay.Setup
+	}
+	if overlay.HelpTemplate != "" {
+		base.HelpTemplate = overlay.HelpTemplate
+	}
+	base.MaskEnv = append(base.MaskEnv, overlay.MaskEnv...)
+	return commands
+}
 
-	for _, name := range keys {
-		cmd := config.Commands[name]
+// getExtraConfig loads an ahoy file given by a second or later -f flag, or
+// by --commands-from.
+func getExtraConfig(file string) Config {
+	path, err := getConfigPath(file)
+	if err != nil {
+		logger("fatal", err.Error())
+	}
+	logger("debug", "Merging commands from "+path)
+	cfg, err := getConfig(path)
+	if err != nil {
+		configError(err)
+	}
+	return cfg
+}
 
-		// Check that a command has 'cmd' OR 'imports' set.
-		if cmd.Cmd == "" && cmd.Imports == nil {
-			logger("fatal", "Command ["+name+"] has neither 'cmd' or 'imports' set. Check your yaml file.")
+// getCompletions runs a command's complete snippet through its entrypoint
+// and returns the lines it prints. Completion snippets that call ahoy don't
+// get completions themselves, so a command can't end up completing itself.
+func getCompletions(cmd config.ResolvedCommand) ([]string, error) {
+	if os.Getenv("AHOY_COMPLETING") != "" {
+		return nil, nil
+	}
+	completeCmd := cmd
+	completeCmd.Cmd = cmd.Complete
+	command := getExecCommand(completeCmd, cmd.Name, nil)
+	command.Env = append(os.Environ(), "AHOY_COMPLETING=1")
+	command.Stderr = os.Stderr
+	out, err := command.Output()
+	if err != nil {
+		return nil, err
+	}
+	var completions []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			completions = append(completions, line)
 		}
+	}
+	return completions, nil
+}
 
-		// Check that a command has 'cmd' OR 'imports' set.
-		if cmd.Cmd != "" && cmd.Imports != nil {
-			logger("fatal", "Command ["+name+"] has both 'cmd' and 'imports' set, but only one is allowed. Check your yaml file.")
+// getArgsUsage builds a usage line like "<env> [tag]" from a command's
+// arguments, with required arguments in angle brackets.
+func getArgsUsage(arguments []config.Argument) string {
+	var usage []string
+	for _, arg := range arguments {
+		if arg.Required {
+			usage = append(usage, "<"+arg.Name+">")
+		} else {
+			usage = append(usage, "["+arg.Name+"]")
 		}
+	}
+	return strings.Join(usage, " ")
+}
 
-		// Check that a command with 'imports' set has a least one entry.
-		if cmd.Imports != nil && len(cmd.Imports) == 0 {
-			logger("fatal", "Command ["+name+"] has 'imports' set, but it is empty. Check your yaml file.")
-		}
+// getLocalConfig loads the .ahoy.local.yml next to the ahoy file, which holds
+// personal overrides that aren't committed. It returns false if there isn't one.
+func getLocalConfig() (Config, bool) {
+	if noLocal || AhoyConf.srcFile == "-" {
+		return Config{}, false
+	}
+	localFile := filepath.Join(AhoyConf.srcDir, ".ahoy.local.yml")
+	if filepath.Clean(AhoyConf.srcFile) == localFile {
+		return Config{}, false
+	}
+	if _, err := os.Stat(localFile); err != nil {
+		return Config{}, false
+	}
+	logger("debug", "Merging local overrides from "+localFile)
+	cfg, err := getConfig(localFile)
+	if err != nil {
+		configError(err)
+	}
+	return cfg, true
+}
+
+// getCliCommands turns resolved ahoy commands into cli commands that run
+// through the command's entrypoint.
+func getCliCommands(commands []config.ResolvedCommand) []cli.Command {
+	exportCmds := []cli.Command{}
 
+	for _, cmd := range commands {
+		cmd := cmd
 		newCmd := cli.Command{
-			Name:            name,
+			Name:            cmd.Name,
 			SkipFlagParsing: true,
-			HideHelp:        cmd.Hide,
+			HideHelp:        cmd.IsHidden() && !listHidden,
 		}
 
 		if cmd.Usage != "" {
 			newCmd.Usage = cmd.Usage
 		}
+		// --list-hidden shows hidden commands, marked so they stand out.
+		if cmd.IsHidden() && listHidden {
+			newCmd.Usage = strings.TrimSpace("[hidden] " + newCmd.Usage)
+		}
 
-		if cmd.Cmd != "" {
-			newCmd.Action = func(c *cli.Context) {
-				// For some unclear reason, if we don't add an item at the end here,
-				// the first argument is skipped... actually it's not!
-				// 'bash -c' says that arguments will be passed starting with $0, which also means that
-				// $@ skips the first item. See http://stackoverflow.com/questions/41043163/xargs-sh-c-skipping-the-first-argument
-				var cmdItems []string
-				var cmdArgs []string
-				var cmdEntrypoint []string
+		if len(cmd.Arguments) > 0 {
+			newCmd.ArgsUsage = getArgsUsage(cmd.Arguments)
+		}
 
+		if cmd.Complete != "" {
+			newCmd.BashComplete = func(c *cli.Context) {
+				completions, err := getCompletions(cmd)
+				if err != nil {
+					logger("debug", "Couldn't complete "+cmd.Name+": "+err.Error())
+				}
+				for _, completion := range completions {
+					fmt.Fprintln(c.App.Writer, completion)
+				}
+			}
+		}
+
+		// The description is the longer text shown by 'ahoy --help <command>'.
+		if cmd.Description != "" {
+			newCmd.Description = cmd.Description
+		}
+
+		if cmd.Cmd != "" || len(cmd.Parallel) > 0 || len(cmd.Steps) > 0 {
+			newCmd.Action = func(c *cli.Context) {
 				// c.Args()  is not a slice apparently.
+				var cmdArgs []string
 				for _, arg := range c.Args() {
 					cmdArgs = append(cmdArgs, arg)
 				}
-
-				// Replace the entry point placeholders.
-				cmdEntrypoint = config.Entrypoint[:]
-				for i := range cmdEntrypoint {
-					if cmdEntrypoint[i] == "{{cmd}}" {
-						cmdEntrypoint[i] = cmd.Cmd
-					} else if cmdEntrypoint[i] == "{{name}}" {
-						cmdEntrypoint[i] = c.Command.Name
-					}
+				run := runCommand
+				if watch {
+					run = runWatch
 				}
-				cmdItems = append(cmdEntrypoint, cmdArgs...)
-
-				if verbose {
-					log.Println("===> AHOY", name, "from", sourcefile, ":", cmdItems)
+				err := runSetup(cmd.Name)
+				if err == nil {
+					err = run(cmd, c.Command.Name, cmdArgs)
 				}
-				command := exec.Command(cmdItems[0], cmdItems[1:]...)
-				command.Dir = AhoyConf.srcDir
-				command.Stdout = os.Stdout
-				command.Stdin = os.Stdin
-				command.Stderr = os.Stderr
-				if err := command.Run(); err != nil {
-					fmt.Fprintln(os.Stderr)
-					os.Exit(1)
+				if err == nil && cmd.Name == AhoyConf.setupCommand {
+					markSetupDone()
+				}
+				if err != nil {
+					var execErr *exec.Error
+					if errors.As(err, &execErr) && errors.Is(err, exec.ErrNotFound) {
+						fmt.Fprintf(os.Stderr, "ahoy: shell '%s' not found on PATH; set 'entrypoint:' in your config\n", execErr.Name)
+					} else if !errors.Is(err, errAborted) {
+						fmt.Fprintln(os.Stderr)
+					}
+					exit(getExitCode(err))
 				}
 			}
 		}
 
-		if cmd.Imports != nil {
-			subCommands := getSubCommands(cmd.Imports)
-			if subCommands == nil || len(subCommands) == 0 {
-				logger("fatal", "Command ["+name+"] has 'imports' set, but no commands were found. Check your yaml file.")
-			}
-			newCmd.Subcommands = subCommands
+		if cmd.Subcommands != nil {
+			newCmd.Subcommands = getCliCommands(cmd.Subcommands)
 		}
 
 		//log.Println("found command: ", name, " > ", cmd.Cmd )
@@ -253,39 +460,384 @@ func getCommands(config Config) []cli.Command {
 	return exportCmds
 }
 
+// commandIO is where a command reads its input from and writes its output
+// to. With prefix set, each line of output starts with the command's name.
+type commandIO struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+	prefix         bool
+	// mu is shared by commands whose prefixed lines mustn't interleave.
+	mu *sync.Mutex
+}
+
+// runCommand runs an ahoy command through its entrypoint, passing along args.
+func runCommand(cmd config.ResolvedCommand, name string, args []string) error {
+	return runCommandIO(cmd, name, args, commandIO{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr, prefix: prefixOutput})
+}
+
+// runCommandIO does the work of runCommand, with the command's input and
+// output given by cio.
+func runCommandIO(cmd config.ResolvedCommand, name string, args []string, cio commandIO) (err error) {
+	if auditLog := getAuditLogPath(); auditLog != "" {
+		start := time.Now()
+		defer func() { writeAuditRecord(auditLog, cmd, args, start, err) }()
+	}
+	if timeCommands || cmd.Time {
+		start := time.Now()
+		defer func() {
+			fmt.Fprintf(os.Stderr, "command '%s' took %.2fs\n", cmd.Name, time.Since(start).Seconds())
+		}()
+	}
+
+	if cmd.Confirm != "" && !assumeYes {
+		if !isTerminal(os.Stdin) || !confirm(os.Stdin, os.Stderr, cmd.Confirm) {
+			fmt.Fprintf(os.Stderr, "Aborted '%s'. Use --yes to run it without asking.\n", cmd.Name)
+			return errAborted
+		}
+	}
+
+	if len(cmd.Depends) > 0 {
+		if err := runDependencies(cmd); err != nil {
+			return err
+		}
+	}
+
+	if len(cmd.Parallel) > 0 {
+		return runParallel(cmd)
+	}
+	if len(cmd.Steps) > 0 {
+		return runSteps(cmd)
+	}
+
+	if !force {
+		upToDate, err := isUpToDate(cmd)
+		if err != nil {
+			return err
+		}
+		if upToDate {
+			fmt.Fprintf(os.Stderr, "command '%s' is up to date, skipping\n", cmd.Name)
+			return nil
+		}
+	}
+
+	command := getExecCommand(cmd, name, args)
+	command.Stdout = cio.stdout
+	command.Stdin = cio.stdin
+	command.Stderr = cio.stderr
+
+	// --prefix marks each line of output with the command it came from.
+	// Interactive commands write straight to the terminal.
+	if cio.prefix && !cmd.Interactive {
+		mu := cio.mu
+		if mu == nil {
+			mu = &sync.Mutex{}
+		}
+		stdout := newPrefixWriter(cio.stdout, "["+cmd.Name+"] ", mu)
+		stderr := newPrefixWriter(cio.stderr, "["+cmd.Name+"] ", mu)
+		defer stdout.Flush()
+		defer stderr.Flush()
+		command.Stdout = stdout
+		command.Stderr = stderr
+	}
+
+	if !cmd.Interactive {
+		return runWithShutdown(command)
+	}
+
+	// Interactive commands (editors, 'docker exec -it', ...) get the signals
+	// meant for them instead of ahoy exiting underneath them, and the
+	// terminal is put back the way it was once they're done.
+	terminalState := saveTerminalState()
+	defer restoreTerminalState(terminalState)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, interactiveSignals...)
+	defer signal.Stop(signals)
+
+	if err := command.Start(); err != nil {
+		return err
+	}
+	// Like runWithShutdown, Ctrl-C from a terminal has already reached the
+	// command in our process group, so it isn't sent a second time.
+	fromTerminal := isTerminal(command.Stdin)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if !fromTerminal || sig != os.Interrupt {
+					command.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return command.Wait()
+}
+
+// errInterrupted is returned when ahoy was told to stop while a command ran.
+var errInterrupted = errors.New("interrupted")
+
+// getExitCode returns the exit code of a failed command, so ahoy can exit
+// with the same code. Interrupted commands give 130, a missing shell gives
+// exitShellNotFound, and other errors that aren't from the command exiting give 1.
+func getExitCode(err error) int {
+	if errors.Is(err, errInterrupted) {
+		return 130
+	}
+	if errors.Is(err, exec.ErrNotFound) {
+		return exitShellNotFound
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+// getExecCommand builds the process that runs cmd through its entrypoint.
+func getExecCommand(cmd config.ResolvedCommand, name string, args []string) *exec.Cmd {
+	// For some unclear reason, if we don't add an item at the end here,
+	// the first argument is skipped... actually it's not!
+	// 'bash -c' says that arguments will be passed starting with $0, which also means that
+	// $@ skips the first item. See http://stackoverflow.com/questions/41043163/xargs-sh-c-skipping-the-first-argument
+	var cmdItems []string
+	var cmdEntrypoint []string
+
+	// Replace the entry point placeholders.
+	cmdEntrypoint = append(cmdEntrypoint, cmd.Entrypoint...)
+	for i := range cmdEntrypoint {
+		if cmdEntrypoint[i] == "{{cmd}}" {
+			cmdEntrypoint[i] = getErrexitPrefix(cmd) + cmd.Cmd
+		} else if cmdEntrypoint[i] == "{{name}}" {
+			cmdEntrypoint[i] = name
+		}
+	}
+	// --trace has bash and sh print each command as it is run.
+	if trace && getShellName(cmd) != "" {
+		cmdEntrypoint = append([]string{cmdEntrypoint[0], "-x"}, cmdEntrypoint[1:]...)
+	}
+	cmdItems = append(cmdEntrypoint, args...)
+
+	if verbose {
+		log.Print(maskSecrets(fmt.Sprintln("===> AHOY", cmd.Name, "from", sourcefile, ":", cmdItems)))
+	}
+	command := exec.Command(cmdItems[0], cmdItems[1:]...)
+	command.Dir = AhoyConf.srcDir
+	// Variables given with --env win over anything already in the environment.
+	if len(envOverrides) > 0 {
+		command.Env = append(os.Environ(), envOverrides...)
+	}
+	return command
+}
+
+// getShellName returns "bash" or "sh" when cmd runs through one of them, and
+// "" for other entrypoints.
+func getShellName(cmd config.ResolvedCommand) string {
+	if len(cmd.Entrypoint) == 0 {
+		return ""
+	}
+	if shell := filepath.Base(cmd.Entrypoint[0]); shell == "bash" || shell == "sh" {
+		return shell
+	}
+	return ""
+}
+
+// getErrexitPrefix returns the shell options that make cmd fail fast, when
+// --errexit or its config's errexit is set and it runs in bash or sh.
+func getErrexitPrefix(cmd config.ResolvedCommand) string {
+	if !errexit && !cmd.Errexit {
+		return ""
+	}
+	switch getShellName(cmd) {
+	case "bash":
+		return "set -euo pipefail\n"
+	case "sh":
+		// pipefail isn't POSIX, so plain sh only gets -eu.
+		return "set -eu\n"
+	}
+	return ""
+}
+
+// findCommand looks up a resolved command by name. Names of subcommands are
+// given as a path, like "docker build".
+func findCommand(name string) (config.ResolvedCommand, bool) {
+	commands := AhoyConf.commands
+	var found config.ResolvedCommand
+	for _, part := range strings.Fields(name) {
+		ok := false
+		for _, cmd := range commands {
+			if cmd.Name == part {
+				found, ok = cmd, true
+				commands = cmd.Subcommands
+				break
+			}
+		}
+		if !ok {
+			return found, false
+		}
+	}
+	return found, found.Name != ""
+}
+
+// saveTerminalState returns the current stty settings so they can be restored
+// later, or "" if stdin isn't a terminal.
+func saveTerminalState() string {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return ""
+	}
+	stty := exec.Command("stty", "-g")
+	stty.Stdin = os.Stdin
+	state, err := stty.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(state))
+}
+
+func restoreTerminalState(state string) {
+	if state == "" {
+		return
+	}
+	stty := exec.Command("stty", state)
+	stty.Stdin = os.Stdin
+	stty.Run()
+}
+
 func addDefaultCommands(commands []cli.Command) []cli.Command {
+	if noDefaultCommands {
+		return commands
+	}
 
 	defaultInitCmd := cli.Command{
-		Name:  "init",
-		Usage: "Initialize a new .ahoy.yml config file in the current directory.",
+		Name:      "init",
+		Usage:     "Initialize a new .ahoy.yml config file in the current directory.",
+		ArgsUsage: "[url]",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "output, o",
+				Value: ".ahoy.yml",
+				Usage: "Write the config file to this path, creating any missing directories.",
+			},
+			cli.BoolFlag{
+				Name:  "stdout",
+				Usage: "Write the config file to stdout instead of a file.",
+			},
+		},
 		Action: func(c *cli.Context) {
 			// Grab the URL or use a default for the initial ahoy file.
-			// Allows users to define their own files to call to init.
-			var wgetURL = "https://raw.githubusercontent.com/ahoy-cli/ahoy/master/examples/examples.ahoy.yml"
+			// Allows users to define their own files to call to init, or to
+			// point every init at their own template with AHOY_INIT_URL.
+			var initURL = "https://raw.githubusercontent.com/ahoy-cli/ahoy/master/examples/examples.ahoy.yml"
 			if len(c.Args()) > 0 {
-				wgetURL = c.Args()[0]
+				initURL = c.Args()[0]
+			} else if envURL := os.Getenv("AHOY_INIT_URL"); envURL != "" {
+				initURL = envURL
+			}
+			if c.Bool("stdout") {
+				if c.IsSet("output") {
+					logger("fatal", "Only one of --stdout and --output can be used.")
+				}
+				if err := config.Download(os.Stdout, initURL); err != nil {
+					logger("fatal", err.Error())
+				}
+				return
 			}
-			grabYaml := "wget " + wgetURL + " -O .ahoy.yml"
-			cmd := exec.Command("bash", "-c", grabYaml)
-			cmd.Stdin = os.Stdin
-			cmd.Stderr = os.Stderr
-			if err := cmd.Run(); err != nil {
-				fmt.Fprintln(os.Stderr)
-				os.Exit(1)
+			output := c.String("output")
+			if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+				logger("fatal", err.Error())
+			}
+			if err := config.DownloadFile(output, initURL); err != nil {
+				logger("fatal", err.Error())
+			} else if output == ".ahoy.yml" {
+				fmt.Fprintln(os.Stderr, "example.ahoy.yml downloaded to the current directory. You can customize it to suit your needs!")
 			} else {
-				fmt.Println("example.ahoy.yml downloaded to the current directory. You can customize it to suit your needs!")
+				fmt.Fprintln(os.Stderr, "example.ahoy.yml downloaded to "+output+". You can customize it to suit your needs!")
+			}
+		},
+	}
+
+	userCommands := commands
+	defaultRunCmd := cli.Command{
+		Name:            "run",
+		Usage:           "Run a command from the ahoy file, even if its name clashes with a built-in.",
+		ArgsUsage:       "<command> [arguments...]",
+		SkipFlagParsing: true,
+		Action: func(c *cli.Context) {
+			if !c.Args().Present() {
+				logger("fatal", "Missing the name of the command to run.")
+			}
+			for _, userCmd := range userCommands {
+				if userCmd.HasName(c.Args().First()) {
+					userCmd.Run(c)
+					return
+				}
+			}
+			logger("fatal", "Command not found for '"+c.Args().First()+"'")
+		},
+	}
+
+	defaultDoctorCmd := cli.Command{
+		Name:  "doctor",
+		Usage: "Check that the shell and files ahoy needs are available.",
+		Action: func(c *cli.Context) {
+			if !runDoctor() {
+				exit(1)
+			}
+		},
+	}
+
+	defaultDocsCmd := cli.Command{
+		Name:  "docs",
+		Usage: "Generate documentation for the commands in the ahoy file.",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "format",
+				Value: "markdown",
+				Usage: "Format of the documentation. Only markdown is supported.",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "Write the documentation to this file instead of stdout.",
+			},
+		},
+		Action: func(c *cli.Context) {
+			if c.String("format") != "markdown" {
+				logger("fatal", "Unsupported documentation format '"+c.String("format")+"'. Only markdown is supported.")
+			}
+			var out bytes.Buffer
+			writeMarkdownDocs(&out, AhoyConf.commands)
+			if c.String("output") == "" {
+				stdout.Write(out.Bytes())
+				return
+			}
+			if err := ioutil.WriteFile(c.String("output"), out.Bytes(), 0644); err != nil {
+				logger("fatal", err.Error())
 			}
 		},
 	}
 
-	// Don't add default commands if they've already been set.
-	if c := app.Command(defaultInitCmd.Name); c == nil {
-		commands = append(commands, defaultInitCmd)
+	// Commands defined by the user always win over the default commands.
+	for _, defaultCmd := range []cli.Command{defaultInitCmd, defaultRunCmd, defaultDoctorCmd, defaultDocsCmd} {
+		if !hasCommand(userCommands, defaultCmd.Name) {
+			commands = append(commands, defaultCmd)
+		}
 	}
 	return commands
 }
 
-//TODO Move these to flag.go?
+func hasCommand(commands []cli.Command, name string) bool {
+	for _, c := range commands {
+		if c.HasName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// TODO Move these to flag.go?
 func init() {
 	logger("debug", "init()")
 	flag.StringVar(&sourcefile, "f", "", "specify the sourcefile")
@@ -293,14 +845,12 @@ func init() {
 	flag.BoolVar(&verbose, "verbose", false, "")
 }
 
-// BashComplete prints the list of subcommands as the default app completion method
+// BashComplete prints the list of subcommands as the default app completion
+// method. Only command names and aliases are printed, as anything else would
+// be offered as a completion too.
 func BashComplete(c *cli.Context) {
 	logger("debug", "BashComplete()")
 
-	if sourcefile != "" {
-		log.Println(sourcefile)
-		os.Exit(0)
-	}
 	for _, command := range c.App.Commands {
 		for _, name := range command.Names() {
 			fmt.Fprintln(c.App.Writer, name)
@@ -318,6 +868,14 @@ func NoArgsAction(c *cli.Context) {
 		logger("fatal", msg)
 	}
 
+	if AhoyConf.defaultCommand != "" && !c.Bool("help") {
+		if defaultCmd := c.App.Command(AhoyConf.defaultCommand); defaultCmd != nil {
+			defaultCmd.Run(c)
+			return
+		}
+		logger("warn", "The default command '"+AhoyConf.defaultCommand+"' doesn't exist.")
+	}
+
 	cli.ShowAppHelp(c)
 
 	if AhoyConf.srcFile == "" {
@@ -329,19 +887,44 @@ func NoArgsAction(c *cli.Context) {
 	}
 
 	// Looks like we never reach here.
-	fmt.Println("ERROR: NoArg Action ")
+	fmt.Fprintln(os.Stderr, "ERROR: NoArg Action ")
 }
 
 // BeforeCommand runs before every command so arguments or flags must be passed
 func BeforeCommand(c *cli.Context) error {
 	args := c.Args()
 	if c.Bool("version") {
-		fmt.Println(version)
+		fmt.Fprintln(stdout, version)
+		return errors.New("don't continue with commands")
+	}
+	if explain {
+		if !args.Present() {
+			logger("fatal", "Missing the name of the command to explain.")
+		}
+		if !explainCommand(args) {
+			logger("fatal", "Command not found for '"+strings.Join(args, " ")+"'")
+		}
+		return errors.New("don't continue with commands")
+	}
+	if dumpEnvironment {
+		if !args.Present() {
+			logger("fatal", "Missing the name of the command to dump the environment of.")
+		}
+		if !dumpEnv(args) {
+			logger("fatal", "Command not found for '"+strings.Join(args, " ")+"'")
+		}
 		return errors.New("don't continue with commands")
 	}
+	if batch || keepGoing {
+		if !args.Present() {
+			logger("fatal", "Missing the names of the commands to run.")
+		}
+		exit(runBatch(args, keepGoing))
+	}
 	if c.Bool("help") {
 		if len(args) > 0 {
 			cli.ShowCommandHelp(c, args.First())
+			printCommandDetails(args.First())
 		} else {
 			cli.ShowAppHelp(c)
 		}
@@ -351,6 +934,44 @@ func BeforeCommand(c *cli.Context) error {
 	return nil
 }
 
+// printConfigFile prints the absolute path of the ahoy file for
+// --print-config-path and exits, with 1 if there isn't one.
+func printConfigFile(file string, err error) {
+	if err != nil {
+		logger("fatal", err.Error())
+	}
+	if file == "" {
+		logger("fatal", "No .ahoy.yml found.")
+	}
+	if file != "-" {
+		file, _ = filepath.Abs(file)
+	}
+	fmt.Fprintln(stdout, file)
+	exit(0)
+}
+
+// printCommandDetails adds the command's arguments and examples to its help.
+func printCommandDetails(name string) {
+	cmd, ok := findCommand(name)
+	if !ok {
+		return
+	}
+	if len(cmd.Arguments) > 0 {
+		fmt.Fprintln(stdout, "\nARGUMENTS:")
+		w := tabwriter.NewWriter(stdout, 0, 8, 1, '\t', 0)
+		for _, arg := range cmd.Arguments {
+			fmt.Fprintln(w, "   "+arg.Name+"\t"+arg.Description)
+		}
+		w.Flush()
+	}
+	if len(cmd.Examples) > 0 {
+		fmt.Fprintln(stdout, "\nEXAMPLES:")
+		for _, example := range cmd.Examples {
+			fmt.Fprintln(stdout, "   "+example)
+		}
+	}
+}
+
 func setupApp(localArgs []string) *cli.App {
 	var err error
 	initFlags(localArgs)
@@ -363,9 +984,30 @@ func setupApp(localArgs []string) *cli.App {
 	app.Usage = "Creates a configurable cli app for running commands."
 	app.EnableBashCompletion = true
 	app.BashComplete = BashComplete
+	app.Writer = stdout
+	cli.AppHelpTemplate = defaultHelpTemplate
 	overrideFlags(app)
+	config.Warn = func(msg string) { logger("warn", msg) }
+	config.AhoyVersion = version
+
+	for _, kv := range envOverrides {
+		if !strings.Contains(kv, "=") || strings.HasPrefix(kv, "=") {
+			logger("fatal", "Invalid --env '"+kv+"'. Use --env KEY=VALUE.")
+		}
+	}
+
+	// Behave as if ahoy was run from --cwd, so both config discovery and
+	// relative -f paths start from there.
+	if workingDir != "" {
+		if err := os.Chdir(workingDir); err != nil {
+			logger("fatal", "Couldn't change to the --cwd directory: "+err.Error())
+		}
+	}
 
 	AhoyConf.srcFile, err = getConfigPath(sourcefile)
+	if printConfigPath {
+		printConfigFile(AhoyConf.srcFile, err)
+	}
 	if err != nil {
 		logger("fatal", err.Error())
 	} else {
@@ -373,21 +1015,68 @@ func setupApp(localArgs []string) *cli.App {
 		// If we don't have a sourcefile, then just supply the default commands.
 		if AhoyConf.srcFile == "" {
 			app.Commands = addDefaultCommands(app.Commands)
-			app.Run(os.Args)
-			os.Exit(0)
+			app.Run(append([]string{os.Args[0]}, localArgs...))
+			exit(0)
+		}
+		cfg, err := getConfig(AhoyConf.srcFile)
+		if err != nil {
+			configError(err)
 		}
-		config, err := getConfig(AhoyConf.srcFile)
+		if importBase != "" {
+			cfg.ImportBase, _ = filepath.Abs(config.ExpandPath(importBase))
+		}
+		// Imports can provide the usage when the ahoy file doesn't set one.
+		commands, usage, err := config.ResolveWithUsage(cfg)
 		if err != nil {
 			logger("fatal", err.Error())
 		}
-		app.Commands = getCommands(config)
+		cfg.Usage = usage
+		// Files given with more -f flags are merged on top, left to right.
+		for i, extraFile := range sourcefiles {
+			if i == 0 {
+				continue
+			}
+			commands = mergeConfig(&cfg, commands, getExtraConfig(extraFile))
+		}
+		// Local overrides win over the project's commands and usage.
+		if localCfg, ok := getLocalConfig(); ok {
+			commands = mergeConfig(&cfg, commands, localCfg)
+		}
+		// --commands-from files win over everything else, left to right.
+		for _, commandsFile := range commandsFrom {
+			commands = mergeConfig(&cfg, commands, getExtraConfig(commandsFile))
+		}
+		// Project commands override any global commands with the same name.
+		AhoyConf.commands = config.MergeCommands(getGlobalCommands(), commands)
+		app.Commands = getCliCommands(AhoyConf.commands)
 		app.Commands = addDefaultCommands(app.Commands)
-		if config.Usage != "" {
-			app.Usage = config.Usage
+		if cfg.Usage != "" {
+			app.Usage = cfg.Usage
+		}
+		if cfg.HelpTemplate != "" {
+			if err := checkHelpTemplate(app, cfg.HelpTemplate); err != nil {
+				logger("fatal", "help_template is invalid: "+err.Error())
+			}
+			cli.AppHelpTemplate = cfg.HelpTemplate
+		}
+		AhoyConf.defaultCommand = cfg.Default
+		AhoyConf.setupCommand = cfg.Setup
+		AhoyConf.auditLog = cfg.AuditLog
+		for _, pattern := range cfg.MaskEnv {
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				logger("fatal", "mask_env has an invalid pattern '"+pattern+"': "+err.Error())
+			}
+			AhoyConf.maskEnv = append(AhoyConf.maskEnv, re)
 		}
 	}
 
-	cli.AppHelpTemplate = `NAME:
+	return app
+}
+
+// defaultHelpTemplate is ahoy's main help output, which a config file can
+// replace with help_template.
+var defaultHelpTemplate = `NAME:
    {{.Name}} - {{.Usage}}
 USAGE:
    {{.HelpName}} {{if .Flags}}[global options]{{end}}{{if .Commands}} command [command options]{{end}} {{if .ArgsUsage}}{{.ArgsUsage}}{{else}}[arguments...]{{end}}
@@ -408,11 +1097,56 @@ VERSION:
    {{end}}
 `
 
-	return app
+// checkHelpTemplate renders a help_template against app, so that a broken
+// template is reported up front rather than when help is shown.
+func checkHelpTemplate(app *cli.App, text string) error {
+	funcMap := template.FuncMap{
+		"join": strings.Join,
+	}
+	t, err := template.New("help").Funcs(funcMap).Parse(text)
+	if err != nil {
+		return err
+	}
+	return t.Execute(ioutil.Discard, app)
 }
 
-func main() {
+// exitCode is what exit panics with, for Run to recover and return.
+type exitCode int
+
+// exit stops ahoy with code. Rather than calling os.Exit, it unwinds back to
+// Run, so that deferred cleanups happen and Run can be called from tests.
+func exit(code int) {
+	panic(exitCode(code))
+}
+
+// Run runs ahoy with args, which start with the program name like os.Args,
+// and returns its exit code.
+func Run(args []string) (code int) {
+	defer func() {
+		if r := recover(); r != nil {
+			// Writers like tabwriter wrap the panic from exit in their own
+			// when stdout has gone away, which is still a quiet exit.
+			c, ok := r.(exitCode)
+			if !ok && !stdoutClosed {
+				panic(r)
+			}
+			code = int(c)
+		}
+	}()
+
+	// --cwd changes directory for the run only, so callers get theirs back.
+	if wd, err := os.Getwd(); err == nil {
+		defer os.Chdir(wd)
+	}
+
+	catchBrokenPipe()
+	stdoutClosed = false
 	logger("debug", "main()")
-	app = setupApp(os.Args[1:])
-	app.Run(os.Args)
+	app = setupApp(args[1:])
+	app.Run(args)
+	return 0
+}
+
+func main() {
+	os.Exit(Run(os.Args))
 }
@@ -1,13 +1,72 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"github.com/ahoy-cli/ahoy/config"
+	"github.com/codegangsta/cli"
 	"gopkg.in/yaml.v2"
+	"io"
 	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
+func TestMain(m *testing.M) {
+	// runMain re-runs the test binary with this set so that tests can check
+	// how ahoy exits.
+	if args := os.Getenv("AHOY_TEST_MAIN_ARGS"); args != "" {
+		var mainArgs []string
+		if err := json.Unmarshal([]byte(args), &mainArgs); err != nil {
+			panic(err)
+		}
+		os.Args = append([]string{"ahoy"}, mainArgs...)
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+func TestRunReturnsExitCode(t *testing.T) {
+	if code := Run([]string{"ahoy", "-f", "testdata/simple.ahoy.yml", "echo", "hello"}); code != 0 {
+		t.Errorf("Expected Run to return 0 for a passing command, actual - %d", code)
+	}
+	if code := Run([]string{"ahoy", "-f", "testdata/steps.ahoy.yml", "test"}); code != 3 {
+		t.Errorf("Expected Run to return the failing command's exit code, actual - %d", code)
+	}
+	if code := Run([]string{"ahoy", "-f", "testdata/bad-version.ahoy.yml", "echo"}); code != exitUnsupportedAPI {
+		t.Errorf("Expected Run to return %d for an unsupported ahoyapi, actual - %d", exitUnsupportedAPI, code)
+	}
+
+	// A second Run doesn't see the commands from the first one.
+	if code := Run([]string{"ahoy", "-f", "testdata/parallel.ahoy.yml", "slow"}); code != 0 {
+		t.Errorf("Expected Run to return 0 for a second ahoy file, actual - %d", code)
+	}
+	if code := Run([]string{"ahoy", "-f", "testdata/simple.ahoy.yml", "--explain", "slow"}); code != 1 {
+		t.Errorf("Expected Run to not find a command from the previous ahoy file, actual - %d", code)
+	}
+	if code := Run([]string{"ahoy", "--cwd", t.TempDir(), "--explain", "echo"}); code != 1 {
+		t.Errorf("Expected Run without an ahoy file to not find the previous commands, actual - %d", code)
+	}
+
+	// The ahoy file needs a newer version than this one.
+	defer func(v string) { version = v }(version)
+	version = "v2.4.0"
+	if code := Run([]string{"ahoy", "-f", "testdata/min-version.ahoy.yml", "hello"}); code != 1 {
+		t.Errorf("Expected Run to return 1 for an ahoy file needing a newer ahoy, actual - %d", code)
+	}
+}
+
 func TestOverrideExample(t *testing.T) {
 	expected := "Overrode you.\n"
 	actual, _ := appRun([]string{"ahoy", "-f", "testdata/override-base.ahoy.yml", "docker", "override-example"})
@@ -16,10 +75,959 @@ func TestOverrideExample(t *testing.T) {
 	}
 }
 
+func TestImportBaseFlag(t *testing.T) {
+	generated := t.TempDir() + "/.ahoy.yml"
+	generatedYaml := `
+ahoyapi: v2
+commands:
+  docker:
+    imports:
+      - docker.ahoy.yml
+      - docker-overrides.ahoy.yml
+`
+	if err := ioutil.WriteFile(generated, []byte(generatedYaml), 0644); err != nil {
+		t.Fatal("Error writing the generated ahoy file.")
+	}
+
+	expected := "Overrode you.\n"
+	actual, _ := appRun([]string{"ahoy", "-f", generated, "--import-base", "testdata", "docker", "override-example"})
+	if expected != actual {
+		t.Errorf("ahoy --import-base testdata docker override-example: expected - %s; actual - %s", string(expected), string(actual))
+	}
+
+	// ~ isn't expanded by the shell in --import-base=~/x or $AHOY_IMPORT_BASE.
+	wd, _ := os.Getwd()
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", wd)
+	actual, _ = appRun([]string{"ahoy", "-f", generated, "--import-base=~/testdata", "docker", "override-example"})
+	if expected != actual {
+		t.Errorf("ahoy --import-base=~/testdata docker override-example: expected - %s; actual - %s", string(expected), string(actual))
+	}
+}
+
+func TestNestedCommands(t *testing.T) {
+	expected := "Building images.\n"
+	actual, _ := appRun([]string{"ahoy", "-f", "testdata/nested-commands.ahoy.yml", "docker", "build"})
+	if expected != actual {
+		t.Errorf("ahoy docker build: expected - %s; actual - %s", string(expected), string(actual))
+	}
+}
+
+func TestGlobalCommands(t *testing.T) {
+	home := t.TempDir()
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	defer os.Setenv("XDG_CONFIG_HOME", os.Getenv("XDG_CONFIG_HOME"))
+	os.Setenv("HOME", home)
+	os.Unsetenv("XDG_CONFIG_HOME")
+
+	globalYaml := `
+ahoyapi: v2
+commands:
+  global-only:
+    cmd: echo "global only"
+  echo:
+    cmd: echo "global echo"
+`
+	if err := ioutil.WriteFile(home+"/.ahoy.yml", []byte(globalYaml), 0644); err != nil {
+		t.Fatal("Error writing the global ahoy file.")
+	}
+
+	expected := "global only\n"
+	actual, _ := appRun([]string{"ahoy", "-f", "testdata/simple.ahoy.yml", "global-only"})
+	if expected != actual {
+		t.Errorf("ahoy global-only: expected - %s; actual - %s", string(expected), string(actual))
+	}
+
+	// Project commands win over global ones with the same name.
+	expected = "project\n"
+	actual, _ = appRun([]string{"ahoy", "-f", "testdata/simple.ahoy.yml", "echo", "project"})
+	if expected != actual {
+		t.Errorf("ahoy echo project: expected - %s; actual - %s", string(expected), string(actual))
+	}
+
+	setupApp([]string{"--no-global", "-f", "testdata/simple.ahoy.yml"})
+	if app.Command("global-only") != nil {
+		t.Error("Expected --no-global to leave out global commands.")
+	}
+}
+
+func TestInteractiveCommandForwardsSignals(t *testing.T) {
+	dir := t.TempDir()
+	AhoyConf.srcDir = dir
+	defer func() { AhoyConf.srcDir = "" }()
+
+	// A SIGINT sent to ahoy alone, not from a terminal, is passed on.
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	os.Stdin, _, _ = os.Pipe()
+
+	cmd := config.ResolvedCommand{
+		Command: Command{
+			Cmd:         "trap 'echo interrupted > signal.txt; exit 0' INT; touch ready; while true; do sleep 0.1; done",
+			Interactive: true,
+		},
+		Name:       "wait-for-signal",
+		Entrypoint: config.DefaultEntrypoint,
+	}
+
+	go func() {
+		// Only signal once the child has set up its trap.
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(dir + "/ready"); err == nil {
+				self, _ := os.FindProcess(os.Getpid())
+				self.Signal(os.Interrupt)
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	if err := runCommand(cmd, cmd.Name, nil); err != nil {
+		t.Fatal("Expected the child to exit cleanly after handling SIGINT:", err)
+	}
+
+	actual, _ := ioutil.ReadFile(dir + "/signal.txt")
+	if string(actual) != "interrupted\n" {
+		t.Errorf("Expected SIGINT to be forwarded to the child, actual - %s", string(actual))
+	}
+}
+
+func TestShutdownSignalStopsCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGTERM can't be sent on windows")
+	}
+	signalFile := t.TempDir() + "/signal.txt"
+	var stdout, stderr bytes.Buffer
+	cmd := mainCommand(&stdout, &stderr, "-f", "testdata/shutdown.ahoy.yml", "wait-for-signal", signalFile)
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Couldn't run ahoy:", err)
+	}
+
+	// Only signal once the command has set up its trap.
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(signalFile + ".ready"); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 130 {
+		t.Errorf("Expected ahoy to exit with 130 after SIGTERM, actual - %v: %s", err, stderr.String())
+	}
+	actual, _ := ioutil.ReadFile(signalFile)
+	if string(actual) != "stopped\n" {
+		t.Errorf("Expected SIGTERM to be passed on to the command, actual - %s", string(actual))
+	}
+}
+
+func TestWatchRerunsOnChange(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGTERM can't be sent on windows")
+	}
+	dir := t.TempDir()
+	watchYaml := `
+ahoyapi: v2
+commands:
+  build:
+    cmd: echo run >> runs.txt
+    watch: ["src/*.c"]
+`
+	if err := ioutil.WriteFile(dir+"/.ahoy.yml", []byte(watchYaml), 0644); err != nil {
+		t.Fatal("Error writing the ahoy file.")
+	}
+	os.Mkdir(dir+"/src", 0755)
+	source := dir + "/src/main.c"
+	ioutil.WriteFile(source, []byte("int main;"), 0644)
+
+	waitForRuns := func(runs int) int {
+		var lines int
+		for i := 0; i < 100; i++ {
+			written, _ := ioutil.ReadFile(dir + "/runs.txt")
+			if lines = strings.Count(string(written), "run\n"); lines >= runs {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return lines
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := mainCommand(&stdout, &stderr, "--watch", "-f", dir, "build")
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Couldn't run ahoy:", err)
+	}
+	if runs := waitForRuns(1); runs != 1 {
+		t.Errorf("Expected ahoy --watch to run the command straight away, actual - %d runs", runs)
+	}
+
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(source, later, later)
+	if runs := waitForRuns(2); runs != 2 {
+		t.Errorf("Expected a change to rerun the command, actual - %d runs", runs)
+	}
+
+	cmd.Process.Signal(syscall.SIGTERM)
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 130 {
+		t.Errorf("Expected ahoy --watch to exit with 130 after SIGTERM, actual - %v: %s", err, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "==> change detected, rerunning build") {
+		t.Errorf("Expected a separator between runs, actual - %s", stderr.String())
+	}
+}
+
+func TestClosedStdout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("windows has no SIGPIPE")
+	}
+	for _, args := range [][]string{
+		{"--version"},
+		{"-f", "testdata/description.ahoy.yml", "docs"},
+		{"-f", "testdata/description.ahoy.yml", "--help"},
+	} {
+		// The reader has gone away before ahoy writes anything.
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal("Couldn't create a pipe:", err)
+		}
+		r.Close()
+		var stderr bytes.Buffer
+		cmd := mainCommand(nil, &stderr, args...)
+		cmd.Stdout = w
+		err = cmd.Run()
+		w.Close()
+		if err != nil || stderr.Len() > 0 {
+			t.Errorf("Expected ahoy %s to exit quietly with 0, actual - %v: %s", strings.Join(args, " "), err, stderr.String())
+		}
+	}
+}
+
+func TestBashCompleteWithFile(t *testing.T) {
+	stdout, stderr, _ := runMain(t, "-f", "testdata/simple.ahoy.yml", "--generate-bash-completion")
+	if !strings.Contains(stdout, "echo\n") || !strings.Contains(stdout, "init\n") {
+		t.Errorf("Expected the command names to be completed, actual - %s", stdout)
+	}
+	if strings.Contains(stdout+stderr, "simple.ahoy.yml") {
+		t.Errorf("Expected the ahoy file not to be printed while completing, actual - %s%s", stdout, stderr)
+	}
+}
+
+func TestGetCompletions(t *testing.T) {
+	cmd := config.ResolvedCommand{
+		Command: Command{
+			Cmd:      `echo "deploying to $1"`,
+			Complete: `printf "staging\n\nprod\n"`,
+		},
+		Name:       "deploy",
+		Entrypoint: config.DefaultEntrypoint,
+	}
+	actual, err := getCompletions(cmd)
+	if err != nil || strings.Join(actual, ",") != "staging,prod" {
+		t.Errorf("Expected the lines printed by the complete snippet, actual - %v, %v", actual, err)
+	}
+
+	// A completion snippet that calls ahoy doesn't complete again.
+	os.Setenv("AHOY_COMPLETING", "1")
+	defer os.Unsetenv("AHOY_COMPLETING")
+	if actual, _ = getCompletions(cmd); actual != nil {
+		t.Errorf("Expected no completions while already completing, actual - %v", actual)
+	}
+}
+
+func TestCommandHelpShowsDescription(t *testing.T) {
+	actual, _ := appRun([]string{"ahoy", "-f", "testdata/description.ahoy.yml", "--help", "deploy"})
+	if !strings.Contains(actual, "Deploy the site.") {
+		t.Errorf("ahoy --help deploy: expected the usage; actual - %s", actual)
+	}
+	if !strings.Contains(actual, "Builds the assets and pushes them to the server given as the first argument.") {
+		t.Errorf("ahoy --help deploy: expected the description; actual - %s", actual)
+	}
+	if !strings.Contains(actual, "deploy <env> [tag]\n") {
+		t.Errorf("ahoy --help deploy: expected the usage line to show required and optional arguments; actual - %s", actual)
+	}
+	if !strings.Contains(actual, "ARGUMENTS:\n   env\tThe environment to deploy to.\n   tag\tThe release to deploy, defaulting to the latest.\n") {
+		t.Errorf("ahoy --help deploy: expected the arguments; actual - %s", actual)
+	}
+	if !strings.Contains(actual, "EXAMPLES:\n   ahoy deploy staging\n   ahoy deploy prod --dry\n") {
+		t.Errorf("ahoy --help deploy: expected the examples; actual - %s", actual)
+	}
+
+	// summary and help are the newer names for usage and description.
+	actual, _ = appRun([]string{"ahoy", "-f", "testdata/description.ahoy.yml", "--help", "release"})
+	if !strings.Contains(actual, "release - Tag a release.") || !strings.Contains(actual, "Tags the current commit and pushes the tag.") {
+		t.Errorf("ahoy --help release: expected the summary and help; actual - %s", actual)
+	}
+}
+
+func TestHelpTemplate(t *testing.T) {
+	actual, _ := appRun([]string{"ahoy", "-f", "testdata/help-template.ahoy.yml", "--help"})
+	if !strings.HasPrefix(actual, "ACME TOOLS - Acme project tasks.\n") || !strings.Contains(actual, "* build\tBuild the site.\n") {
+		t.Errorf("ahoy --help: expected the help_template output; actual - %s", actual)
+	}
+
+	_, stderr, code := runMain(t, "-f", "testdata/bad-help-template.ahoy.yml", "build")
+	if code == 0 || !strings.Contains(stderr, "help_template is invalid") || !strings.Contains(stderr, "Bogus") {
+		t.Errorf("Expected an error for the invalid help_template, actual - %d: %s", code, stderr)
+	}
+
+	// Other ahoy files get the default help again.
+	actual, _ = appRun([]string{"ahoy", "-f", "testdata/simple.ahoy.yml", "--help"})
+	if !strings.HasPrefix(actual, "NAME:") {
+		t.Errorf("ahoy --help: expected the default help; actual - %s", actual)
+	}
+}
+
+func TestDefaultCommands(t *testing.T) {
+	setupApp([]string{"-f", "testdata/simple.ahoy.yml"})
+	if app.Command("init") == nil {
+		t.Error("Expected the default init command to be added.")
+	}
+
+	setupApp([]string{"--no-default-commands", "-f", "testdata/simple.ahoy.yml"})
+	if app.Command("init") != nil {
+		t.Error("Expected --no-default-commands to leave out the default init command.")
+	}
+
+	// A user defined init always wins, with or without the flag.
+	for _, args := range [][]string{
+		{"-f", "testdata/user-init.ahoy.yml"},
+		{"--no-default-commands", "-f", "testdata/user-init.ahoy.yml"},
+	} {
+		setupApp(args)
+		if c := app.Command("init"); c == nil || c.Usage != "Set up this project." {
+			t.Errorf("Expected the user defined init command with %v, actual - %+v", args, c)
+		}
+	}
+}
+
+func TestConditionalHide(t *testing.T) {
+	defer os.Unsetenv("AHOY_TEST_CI")
+	defer os.Unsetenv("AHOY_TEST_DEBUG")
+
+	os.Unsetenv("AHOY_TEST_CI")
+	os.Unsetenv("AHOY_TEST_DEBUG")
+	setupApp([]string{"-f", "testdata/conditional-hide.ahoy.yml"})
+	if app.Command("deploy").HideHelp {
+		t.Error("Expected deploy to be visible when $AHOY_TEST_CI isn't set.")
+	}
+	if !app.Command("debug-dump").HideHelp {
+		t.Error("Expected debug-dump to be hidden when $AHOY_TEST_DEBUG isn't set.")
+	}
+
+	os.Setenv("AHOY_TEST_CI", "true")
+	os.Setenv("AHOY_TEST_DEBUG", "1")
+	setupApp([]string{"-f", "testdata/conditional-hide.ahoy.yml"})
+	if !app.Command("deploy").HideHelp {
+		t.Error("Expected deploy to be hidden when $AHOY_TEST_CI is set.")
+	}
+	if app.Command("debug-dump").HideHelp {
+		t.Error("Expected debug-dump to be visible when $AHOY_TEST_DEBUG is set.")
+	}
+
+	// Falsy values don't count as set.
+	os.Setenv("AHOY_TEST_CI", "false")
+	setupApp([]string{"-f", "testdata/conditional-hide.ahoy.yml"})
+	if app.Command("deploy").HideHelp {
+		t.Error("Expected deploy to be visible when $AHOY_TEST_CI is false.")
+	}
+}
+
+func TestListHidden(t *testing.T) {
+	os.Unsetenv("AHOY_TEST_DEBUG")
+	actual, _ := appRun([]string{"ahoy", "-f", "testdata/conditional-hide.ahoy.yml", "--help"})
+	if strings.Contains(actual, "debug-dump") {
+		t.Errorf("ahoy --help: expected debug-dump to be hidden; actual - %s", actual)
+	}
+
+	actual, _ = appRun([]string{"ahoy", "--list-hidden", "-f", "testdata/conditional-hide.ahoy.yml", "--help"})
+	if !strings.Contains(actual, "debug-dump\t[hidden] Only shown when debugging.") {
+		t.Errorf("ahoy --list-hidden --help: expected debug-dump marked as hidden; actual - %s", actual)
+	}
+	if strings.Contains(actual, "[hidden] Hidden on CI.") {
+		t.Errorf("ahoy --list-hidden --help: expected only hidden commands to be marked; actual - %s", actual)
+	}
+
+	stdout, _, _ := runMain(t, "--list-hidden", "-f", "testdata/conditional-hide.ahoy.yml", "docs")
+	if !strings.Contains(stdout, "## `ahoy debug-dump`\n\n*Hidden*\n") {
+		t.Errorf("ahoy --list-hidden docs: expected debug-dump marked as hidden; actual - %s", stdout)
+	}
+	stdout, _, _ = runMain(t, "-f", "testdata/conditional-hide.ahoy.yml", "docs")
+	if strings.Contains(stdout, "debug-dump") {
+		t.Errorf("ahoy docs: expected debug-dump to be left out; actual - %s", stdout)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	expected := "project help topic\n"
+	actual, _ := appRun([]string{"ahoy", "-f", "testdata/builtin-names.ahoy.yml", "run", "help", "topic"})
+	if expected != actual {
+		t.Errorf("ahoy run help topic: expected - %s; actual - %s", string(expected), string(actual))
+	}
+
+	expected = "1.2.3\n"
+	actual, _ = appRun([]string{"ahoy", "-f", "testdata/builtin-names.ahoy.yml", "run", "version"})
+	if expected != actual {
+		t.Errorf("ahoy run version: expected - %s; actual - %s", string(expected), string(actual))
+	}
+}
+
+func TestParallelCommands(t *testing.T) {
+	stdout, _, code := runMain(t, "-f", "testdata/parallel.ahoy.yml", "setup")
+	if code == 0 {
+		t.Error("Expected ahoy setup to fail when one of its parallel commands fails.")
+	}
+
+	// The slow command finishes after the failing one, so its output shows
+	// that the group waited for both.
+	if !strings.Contains(stdout, "[slow] slow done\n") || !strings.Contains(stdout, "[failing] failing\n") {
+		t.Errorf("Expected prefixed output from both commands, actual - %s", stdout)
+	}
+
+	// Parallel commands run like any other, after their depends.
+	stdout, stderr, code := runMain(t, "-f", "testdata/parallel.ahoy.yml", "checks")
+	if code != 0 || stdout != "prepared\n[timed] timed\n" || !strings.Contains(stderr, "command 'timed' took") {
+		t.Errorf("Expected timed to run after prepare and be timed, actual - %d: %s%s", code, stdout, stderr)
+	}
+
+	_, stderr, code = runMain(t, "-f", "testdata/parallel.ahoy.yml", "ask-all")
+	if code == 0 || !strings.Contains(stderr, "need the terminal to itself") {
+		t.Errorf("Expected a parallel command using confirm to be refused, actual - %d: %s", code, stderr)
+	}
+}
+
+func TestPipedCommandCanReadTerminal(t *testing.T) {
+	script, err := exec.LookPath("script")
+	if err != nil || runtime.GOOS != "linux" {
+		t.Skip("Needs util-linux script to run ahoy in a terminal")
+	}
+
+	// script gives ahoy a terminal, while the command's stdin is piped.
+	mainArgs, _ := json.Marshal([]string{"-f", "testdata/tty.ahoy.yml", "ask"})
+	cmd := exec.Command(script, "-qec", `echo piped | "$AHOY_TEST_BINARY" -test.run='^TestMain$'`, "/dev/null")
+	cmd.Env = append(os.Environ(), "AHOY_TEST_BINARY="+os.Args[0], "AHOY_TEST_MAIN_ARGS="+string(mainArgs))
+	cmd.Stdin = strings.NewReader("yes\n")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Couldn't run script:", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(10 * time.Second):
+		cmd.Process.Kill()
+		t.Fatal("Expected the command to read from /dev/tty, but it hung.")
+	}
+	if err != nil || !strings.Contains(out.String(), "answer yes") {
+		t.Errorf("Expected the answer read from the terminal, actual - %v: %s", err, out.String())
+	}
+}
+
+func TestShutdownSignalStopsParallelCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGTERM can't be sent on windows")
+	}
+	signalFile := t.TempDir() + "/signal.txt"
+	os.Setenv("AHOY_TEST_SIGNAL_FILE", signalFile)
+	defer os.Unsetenv("AHOY_TEST_SIGNAL_FILE")
+	var stdout, stderr bytes.Buffer
+	cmd := mainCommand(&stdout, &stderr, "-f", "testdata/parallel.ahoy.yml", "wait-all")
+	if err := cmd.Start(); err != nil {
+		t.Fatal("Couldn't run ahoy:", err)
+	}
+
+	// Only signal once the command has set up its trap.
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(signalFile + ".ready"); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+
+	err := cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 130 {
+		t.Errorf("Expected ahoy to exit with 130 after SIGTERM, actual - %v: %s", err, stderr.String())
+	}
+	actual, _ := ioutil.ReadFile(signalFile)
+	if string(actual) != "stopped\n" {
+		t.Errorf("Expected SIGTERM to be passed on to the parallel command, actual - %s", string(actual))
+	}
+}
+
+func TestStepsCommands(t *testing.T) {
+	stdout, stderr, code := runMain(t, "-f", "testdata/steps.ahoy.yml", "check")
+	if code != 3 {
+		t.Errorf("Expected ahoy check to exit with the failing step's code 3, actual - %d", code)
+	}
+	if stdout != "linted\ntested\n" {
+		t.Errorf("Expected ahoy check to stop at step 2, actual - %s", stdout)
+	}
+	if !strings.Contains(stderr, "==> step 2: test\n") || strings.Contains(stderr, "step 3") {
+		t.Errorf("Expected headers for steps 1 and 2 only, actual - %s", stderr)
+	}
+
+	stdout, _, code = runMain(t, "-f", "testdata/steps.ahoy.yml", "check-all")
+	if code != 3 {
+		t.Errorf("Expected ahoy check-all to exit with the failing step's code 3, actual - %d", code)
+	}
+	if stdout != "linted\ntested\nbuilt\n" {
+		t.Errorf("Expected ahoy check-all to run every step, actual - %s", stdout)
+	}
+
+	stdout, _, code = runMain(t, "-f", "testdata/steps.ahoy.yml", "release")
+	if code != 0 || stdout != "publishing build-42\n" {
+		t.Errorf("Expected the captured output to be passed to the next step, actual - %d: %s", code, stdout)
+	}
+}
+
+func TestSkipUpToDateCommands(t *testing.T) {
+	dir := t.TempDir()
+	buildYaml := `
+ahoyapi: v2
+commands:
+  build:
+    cmd: echo built && mkdir -p dist && touch dist/app
+    inputs: ["src/**"]
+    outputs: [dist/app]
+`
+	if err := ioutil.WriteFile(dir+"/.ahoy.yml", []byte(buildYaml), 0644); err != nil {
+		t.Fatal("Error writing the ahoy file.")
+	}
+	os.MkdirAll(dir+"/src/lib", 0755)
+	source := dir + "/src/lib/main.c"
+	if err := ioutil.WriteFile(source, []byte("int main;"), 0644); err != nil {
+		t.Fatal("Error writing the source file.")
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(source, old, old)
+
+	stdout, _, _ := runMain(t, "-f", dir, "build")
+	if stdout != "built\n" {
+		t.Errorf("Expected the command to run with no outputs yet, actual - %s", stdout)
+	}
+
+	stdout, stderr, code := runMain(t, "-f", dir, "build")
+	if code != 0 || stdout != "" || !strings.Contains(stderr, "command 'build' is up to date, skipping") {
+		t.Errorf("Expected the command to be skipped when its outputs are fresh, actual - %d: %s%s", code, stdout, stderr)
+	}
+
+	stdout, _, _ = runMain(t, "--force", "-f", dir, "build")
+	if stdout != "built\n" {
+		t.Errorf("Expected --force to run the command anyway, actual - %s", stdout)
+	}
+
+	// Touching an input makes the outputs stale again.
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(source, later, later)
+	stdout, _, _ = runMain(t, "-f", dir, "build")
+	if stdout != "built\n" {
+		t.Errorf("Expected the command to run when an input changed, actual - %s", stdout)
+	}
+}
+
+func TestSetupCommand(t *testing.T) {
+	dir := t.TempDir()
+	content, _ := ioutil.ReadFile("testdata/setup.ahoy.yml")
+	ioutil.WriteFile(dir+"/.ahoy.yml", content, 0644)
+	marker := dir + "/.ahoy.setup-done"
+
+	// The setup runs before the first command, and only then.
+	stdout, stderr, code := runMain(t, "-f", dir, "build")
+	if code != 0 || stdout != "installing\nbuilding\n" || !strings.Contains(stderr, "==> install (first run setup)") {
+		t.Errorf("Expected the setup to run before build, actual - %d: %s%s", code, stdout, stderr)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Expected %s to be written, actual - %v", marker, err)
+	}
+	stdout, _, code = runMain(t, "-f", dir, "build")
+	if code != 0 || stdout != "building\n" {
+		t.Errorf("Expected the setup to be skipped the second time, actual - %d: %s", code, stdout)
+	}
+
+	// --skip-setup doesn't run it or mark it as done.
+	os.Remove(marker)
+	stdout, _, _ = runMain(t, "--skip-setup", "-f", dir, "build")
+	if stdout != "building\n" {
+		t.Errorf("Expected --skip-setup to skip the setup, actual - %s", stdout)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("Expected %s not to be written with --skip-setup.", marker)
+	}
+
+	// Running the setup command itself marks it as done.
+	stdout, _, _ = runMain(t, "-f", dir, "install")
+	if stdout != "installing\n" {
+		t.Errorf("Expected the setup command to run once, actual - %s", stdout)
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Expected %s to be written after running the setup command, actual - %v", marker, err)
+	}
+}
+
+func TestBatchCommands(t *testing.T) {
+	stdout, stderr, code := runMain(t, "--batch", "-f", "testdata/steps.ahoy.yml", "lint", "test", "build")
+	if code != 3 || stdout != "linted\ntested\n" {
+		t.Errorf("Expected --batch to stop at the failing command, actual - %d: %s", code, stdout)
+	}
+	if !strings.Contains(stderr, "==> test failed with exit code 3") {
+		t.Errorf("Expected the failure to be reported, actual - %s", stderr)
+	}
+
+	stdout, _, code = runMain(t, "--keep-going", "-f", "testdata/steps.ahoy.yml", "lint", "test", "build")
+	if code != 3 || stdout != "linted\ntested\nbuilt\n" {
+		t.Errorf("Expected --keep-going to run every command, actual - %d: %s", code, stdout)
+	}
+
+	stdout, _, code = runMain(t, "--batch", "-f", "testdata/steps.ahoy.yml", "lint", "missing", "build")
+	if code != 1 || stdout != "" {
+		t.Errorf("Expected --batch to check every command exists before running any, actual - %d: %s", code, stdout)
+	}
+}
+
+func TestDependsCommands(t *testing.T) {
+	stdout, _, code := runMain(t, "-f", "testdata/depends.ahoy.yml", "test")
+	if code != 0 || stdout != "built\nlinted\ntested\n" {
+		t.Errorf("Expected the dependencies to run once each, first, actual - %d: %s", code, stdout)
+	}
+
+	stdout, _, code = runMain(t, "-f", "testdata/depends.ahoy.yml", "deploy")
+	if code != 4 || stdout != "broken\n" {
+		t.Errorf("Expected a failing dependency to stop ahoy deploy, actual - %d: %s", code, stdout)
+	}
+
+	stdout, stderr, code := runMain(t, "-f", "testdata/depends.ahoy.yml", "chicken")
+	if code == 0 || stdout != "" || !strings.Contains(stderr, "Command [chicken] depends on itself: chicken -> egg -> chicken") {
+		t.Errorf("Expected the dependency cycle to be rejected, actual - %d: %s%s", code, stdout, stderr)
+	}
+}
+
+func TestConfirmPrompt(t *testing.T) {
+	var out bytes.Buffer
+	if !confirm(strings.NewReader("yes\n"), &out, "Continue?") {
+		t.Error("Expected 'yes' to confirm")
+	}
+	if out.String() != "Continue? [y/N] " {
+		t.Errorf("Expected the question to be asked, actual - %s", out.String())
+	}
+	for _, answer := range []string{"n\n", "\n", "maybe\n", ""} {
+		if confirm(strings.NewReader(answer), &out, "Continue?") {
+			t.Errorf("Expected %q not to confirm", answer)
+		}
+	}
+
+	// Without a terminal to ask on, the command is aborted.
+	stdout, stderr, code := runMain(t, "-f", "testdata/confirm.ahoy.yml", "reset")
+	if code != 1 || stdout != "" || !strings.Contains(stderr, "Aborted 'reset'") {
+		t.Errorf("Expected ahoy reset to be aborted, actual - %d: %s%s", code, stdout, stderr)
+	}
+
+	stdout, _, code = runMain(t, "--yes", "-f", "testdata/confirm.ahoy.yml", "reset")
+	if code != 0 || stdout != "dropped\n" {
+		t.Errorf("Expected --yes to run ahoy reset, actual - %d: %s", code, stdout)
+	}
+}
+
+func TestEnvFlag(t *testing.T) {
+	os.Setenv("AHOY_TEST_GREETING", "from the environment")
+	defer os.Unsetenv("AHOY_TEST_GREETING")
+
+	stdout, _, code := runMain(t, "--env", "AHOY_TEST_GREETING=hello", "--env", "AHOY_TEST_NAME=ahoy", "-f", "testdata/env.ahoy.yml", "greet")
+	if code != 0 || stdout != "hello ahoy\n" {
+		t.Errorf("Expected the --env values to reach the command, actual - %d: %s", code, stdout)
+	}
+
+	stdout, _, code = runMain(t, "--dump-env", "--env", "AHOY_TEST_GREETING=hello", "-f", "testdata/env.ahoy.yml", "greet")
+	if code != 0 || !strings.Contains("\n"+stdout, "\nAHOY_TEST_GREETING=hello\n") || strings.Contains(stdout, "from the environment") {
+		t.Errorf("Expected --dump-env to print the --env value instead of running the command, actual - %d: %s", code, stdout)
+	}
+
+	_, stderr, code := runMain(t, "--env", "AHOY_TEST_GREETING", "-f", "testdata/env.ahoy.yml", "greet")
+	if code == 0 || !strings.Contains(stderr, "Invalid --env 'AHOY_TEST_GREETING'. Use --env KEY=VALUE.") {
+		t.Errorf("Expected --env without '=' to fail, actual - %d: %s", code, stderr)
+	}
+}
+
+func TestArgumentsKeepTheirQuoting(t *testing.T) {
+	tests := [][]string{
+		{"count", "a b", "c\nd"},
+		{"group", "count", "a b", "c\nd"},
+		{"run", "group", "count", "a b", "c\nd"},
+	}
+	for _, args := range tests {
+		stdout, _, _ := runMain(t, append([]string{"-f", "testdata/args.ahoy.yml"}, args...)...)
+		if stdout != "2|a b|c\nd|" {
+			t.Errorf("Expected ahoy %s to get 2 arguments, actual - %q", strings.Join(args, " "), stdout)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	auditLog := t.TempDir() + "/audit.log"
+	os.Setenv("AHOY_AUDIT_LOG", auditLog)
+	defer os.Unsetenv("AHOY_AUDIT_LOG")
+
+	runMain(t, "-f", "testdata/simple.ahoy.yml", "echo", "hello")
+	runMain(t, "-f", "testdata/steps.ahoy.yml", "test")
+
+	written, err := ioutil.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal("Expected the audit log to be written:", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(written)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a record for each command, actual - %s", written)
+	}
+	var records []auditRecord
+	for _, line := range lines {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Expected each record to be a JSON line, actual - %s", line)
+		}
+		records = append(records, record)
+	}
+	if records[0].Command != "echo" || records[0].ExitCode != 0 || !reflect.DeepEqual(records[0].Args, []string{"hello"}) {
+		t.Errorf("Expected a record of ahoy echo hello succeeding, actual - %+v", records[0])
+	}
+	if records[1].Command != "test" || records[1].ExitCode != 3 {
+		t.Errorf("Expected a record of ahoy test exiting with 3, actual - %+v", records[1])
+	}
+
+	// A broken audit log only warns.
+	os.Setenv("AHOY_AUDIT_LOG", t.TempDir()+"/missing/audit.log")
+	stdout, stderr, code := runMain(t, "-f", "testdata/simple.ahoy.yml", "echo", "hello")
+	if code != 0 || stdout != "hello\n" || !strings.Contains(stderr, "Couldn't write to the audit log") {
+		t.Errorf("Expected the command to run despite the audit log, actual - %d: %s%s", code, stdout, stderr)
+	}
+}
+
+func TestMaskEnv(t *testing.T) {
+	os.Setenv("AHOY_TEST_TOKEN", "s3kr1t")
+	defer os.Unsetenv("AHOY_TEST_TOKEN")
+
+	stdout, stderr, code := runMain(t, "--verbose", "-f", "testdata/mask.ahoy.yml", "login", "token=s3kr1t")
+	if code != 0 || stdout != "token s3kr1t, given token=s3kr1t\n" {
+		t.Errorf("Expected the command to get the real value, actual - %d: %s", code, stdout)
+	}
+	if strings.Contains(stderr, "s3kr1t") || !strings.Contains(stderr, "token=***") {
+		t.Errorf("Expected the value to be masked in the verbose output, actual - %s", stderr)
+	}
+
+	stdout, _, _ = runMain(t, "--explain", "-f", "testdata/mask.ahoy.yml", "login", "token=s3kr1t")
+	if strings.Contains(stdout, "s3kr1t") {
+		t.Errorf("Expected the value to be masked by --explain, actual - %s", stdout)
+	}
+
+	// Values are masked before --explain quotes them or encodes them as JSON.
+	os.Setenv("AHOY_TEST_TOKEN", "s3cr<t&x'y")
+	for _, args := range [][]string{{"--explain"}, {"--explain", "--json"}} {
+		args = append(args, "-f", "testdata/mask.ahoy.yml", "login", "token=s3cr<t&x'y")
+		stdout, _, _ = runMain(t, args...)
+		if strings.Contains(stdout, "s3cr") || !strings.Contains(stdout, "token=***") {
+			t.Errorf("Expected the value to be masked by %s, actual - %s", strings.Join(args[:len(args)-4], " "), stdout)
+		}
+	}
+	os.Setenv("AHOY_TEST_TOKEN", "s3kr1t")
+
+	stdout, _, _ = runMain(t, "--dump-env", "--env", "DB_PASSWORD=hunter2", "-f", "testdata/mask.ahoy.yml", "login")
+	if strings.Contains(stdout, "s3kr1t") || strings.Contains(stdout, "hunter2") || !strings.Contains(stdout, "DB_PASSWORD=***\n") {
+		t.Errorf("Expected the values to be masked by --dump-env, actual - %s", stdout)
+	}
+
+	// Short values would mask unrelated text, so only the variable itself is.
+	os.Setenv("AHOY_TEST_DEBUG", "1")
+	defer os.Unsetenv("AHOY_TEST_DEBUG")
+	stdout, _, _ = runMain(t, "--explain", "-f", "testdata/mask.ahoy.yml", "login", "token=s3kr1t")
+	if !strings.Contains(stdout, "given $1") {
+		t.Errorf("Expected a short value not to be masked by --explain, actual - %s", stdout)
+	}
+	stdout, _, _ = runMain(t, "--dump-env", "-f", "testdata/mask.ahoy.yml", "login")
+	if !strings.Contains(stdout, "AHOY_TEST_DEBUG=***\n") {
+		t.Errorf("Expected a short masked variable to be masked by --dump-env, actual - %s", stdout)
+	}
+}
+
+func TestCommandsFrom(t *testing.T) {
+	stdout, _, code := runMain(t, "-f", "testdata/simple.ahoy.yml", "--commands-from", "testdata/commands-from.ahoy.yml", "echo", "hello")
+	if code != 0 || stdout != "overridden hello\n" {
+		t.Errorf("Expected --commands-from to override ahoy echo, actual - %d: %s", code, stdout)
+	}
+
+	stdout, _, code = runMain(t, "-f", "testdata/simple.ahoy.yml", "--commands-from", "testdata/commands-from.ahoy.yml", "extra")
+	if code != 0 || stdout != "extra\n" {
+		t.Errorf("Expected --commands-from to add ahoy extra, actual - %d: %s", code, stdout)
+	}
+
+	// Imports in --commands-from files follow --import-base like other files.
+	generated := t.TempDir() + "/generated.ahoy.yml"
+	generatedYaml := "ahoyapi: v2\ncommands:\n  docker:\n    imports:\n      - docker.ahoy.yml\n      - docker-overrides.ahoy.yml\n"
+	if err := ioutil.WriteFile(generated, []byte(generatedYaml), 0644); err != nil {
+		t.Fatal("Error writing the generated ahoy file.")
+	}
+	stdout, _, code = runMain(t, "-f", "testdata/simple.ahoy.yml", "--import-base", "testdata", "--commands-from", generated, "docker", "override-example")
+	if code != 0 || stdout != "Overrode you.\n" {
+		t.Errorf("Expected --commands-from imports to use --import-base, actual - %d: %s", code, stdout)
+	}
+}
+
+func TestTraceFlag(t *testing.T) {
+	cmd := config.ResolvedCommand{
+		Command:    Command{Cmd: "echo traced"},
+		Name:       "traced",
+		Entrypoint: config.DefaultEntrypoint,
+	}
+	trace = true
+	defer func() { trace = false }()
+
+	expected := []string{"bash", "-x", "-c", "echo traced", "traced", "one"}
+	if actual := getExecCommand(cmd, cmd.Name, []string{"one"}).Args; !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected --trace to run bash with -x, actual - %v", actual)
+	}
+
+	// Other entrypoints don't know about -x.
+	cmd.Entrypoint = []string{"php", "-r", "{{cmd}}"}
+	if actual := getExecCommand(cmd, cmd.Name, nil).Args; actual[1] == "-x" {
+		t.Errorf("Expected --trace to leave other entrypoints alone, actual - %v", actual)
+	}
+}
+
+func TestErrexit(t *testing.T) {
+	stdout, _, code := runMain(t, "-f", "testdata/errexit.ahoy.yml", "pipeline")
+	if code != 0 || stdout != "after the pipeline\n" {
+		t.Errorf("Expected a failing pipeline stage to be ignored by default, actual - %d: %s", code, stdout)
+	}
+
+	for _, args := range [][]string{
+		{"--errexit", "-f", "testdata/errexit.ahoy.yml", "pipeline"},
+		{"-f", "testdata/errexit-config.ahoy.yml", "pipeline"},
+	} {
+		stdout, _, code = runMain(t, args...)
+		if code == 0 || stdout != "" {
+			t.Errorf("ahoy %s: expected a failing pipeline stage to stop the command, actual - %d: %s", strings.Join(args, " "), code, stdout)
+		}
+	}
+}
+
+func TestLocalOverrides(t *testing.T) {
+	actual, _ := appRun([]string{"ahoy", "-f", "testdata/local/.ahoy.yml", "greet"})
+	if actual != "Hello from the local file.\n" {
+		t.Errorf("ahoy greet: expected the local command to win; actual - %s", actual)
+	}
+	actual, _ = appRun([]string{"ahoy", "-f", "testdata/local/.ahoy.yml", "shared"})
+	if actual != "Still here.\n" {
+		t.Errorf("ahoy shared: expected the base command to be kept; actual - %s", actual)
+	}
+	actual, _ = appRun([]string{"ahoy", "-f", "testdata/local/.ahoy.yml", "--help"})
+	if !strings.Contains(actual, "My local project commands.") {
+		t.Errorf("ahoy --help: expected the local usage to win; actual - %s", actual)
+	}
+
+	actual, _ = appRun([]string{"ahoy", "--no-local", "-f", "testdata/local/.ahoy.yml", "greet"})
+	if actual != "Hello from the base file.\n" {
+		t.Errorf("ahoy --no-local greet: expected the base command; actual - %s", actual)
+	}
+}
+
+func TestMissingShell(t *testing.T) {
+	_, stderr, code := runMain(t, "-f", "testdata/missing-shell.ahoy.yml", "hello")
+	if code != exitShellNotFound {
+		t.Errorf("Expected ahoy to exit with %d when the shell is missing, actual - %d", exitShellNotFound, code)
+	}
+	if stderr != "ahoy: shell 'ahoy-missing-shell' not found on PATH; set 'entrypoint:' in your config\n" {
+		t.Errorf("Expected a clear message about the missing shell, actual - %s", stderr)
+	}
+}
+
+func TestDocsCommand(t *testing.T) {
+	stdout, _, code := runMain(t, "-f", "testdata/description.ahoy.yml", "docs", "--format", "markdown")
+	if code != 0 {
+		t.Errorf("Expected ahoy docs to pass, actual - %d: %s", code, stdout)
+	}
+	for _, expected := range []string{
+		"## `ahoy deploy`\n\nDeploy the site.\n",
+		"ahoy deploy <env> [tag]",
+		"| `env` | yes | The environment to deploy to. |",
+		"## `ahoy release`\n\nTag a release.\n",
+	} {
+		if !strings.Contains(stdout, expected) {
+			t.Errorf("Expected the markdown to contain %q, actual - %s", expected, stdout)
+		}
+	}
+
+	output := t.TempDir() + "/COMMANDS.md"
+	stdout, _, _ = runMain(t, "-f", "testdata/description.ahoy.yml", "docs", "--output", output)
+	written, _ := ioutil.ReadFile(output)
+	if stdout != "" || !strings.Contains(string(written), "## `ahoy deploy`") {
+		t.Errorf("Expected the markdown to be written to %s, actual - %s", output, string(written))
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	stdout, _, code := runMain(t, "-f", "testdata/simple.ahoy.yml", "doctor")
+	pwd, _ := os.Getwd()
+	if code != 0 {
+		t.Errorf("Expected ahoy doctor to pass, actual - %d: %s", code, stdout)
+	}
+	if !strings.Contains(stdout, "[ok] config: "+pwd+"/testdata/simple.ahoy.yml\n") {
+		t.Errorf("Expected ahoy doctor to report the config path, actual - %s", stdout)
+	}
+	if !strings.Contains(stdout, "[ok] shell: bash") {
+		t.Errorf("Expected ahoy doctor to find bash, actual - %s", stdout)
+	}
+
+	stdout, _, code = runMain(t, "-f", "testdata/missing-shell.ahoy.yml", "doctor")
+	if code == 0 {
+		t.Error("Expected ahoy doctor to fail when the shell is missing.")
+	}
+	if !strings.Contains(stdout, "[fail] shell: ahoy-missing-shell wasn't found on your PATH") {
+		t.Errorf("Expected ahoy doctor to report the missing shell, actual - %s", stdout)
+	}
+}
+
+func TestMultipleFiles(t *testing.T) {
+	args := []string{"ahoy", "--no-local", "-f", "testdata/local/.ahoy.yml", "-f", "testdata/overrides"}
+	actual, _ := appRun(append(args, "greet"))
+	if actual != "Hello from the overrides file.\n" {
+		t.Errorf("ahoy greet: expected the second file to win; actual - %s", actual)
+	}
+	actual, _ = appRun(append(args, "shared"))
+	if actual != "Still here.\n" {
+		t.Errorf("ahoy shared: expected commands from the first file to be kept; actual - %s", actual)
+	}
+	actual, _ = appRun(append(args, "imported", "hello"))
+	if actual != "Hello from the overrides import.\n" {
+		t.Errorf("ahoy imported hello: expected imports relative to the second file; actual - %s", actual)
+	}
+
+	// The app parses the flags again, which mustn't add the values twice.
+	appRun([]string{"ahoy", "-f", "testdata/simple.ahoy.yml", "--env", "A=1", "--commands-from", "testdata/commands-from.ahoy.yml", "echo"})
+	if len(sourcefiles) != 1 || len(envOverrides) != 1 || len(commandsFrom) != 1 {
+		t.Errorf("Expected one value for each flag given once, actual - %v, %v, %v", sourcefiles, envOverrides, commandsFrom)
+	}
+}
+
+func TestDefaultCommand(t *testing.T) {
+	stdout, _, code := runMain(t, "-f", "testdata/default.ahoy.yml")
+	if code != 0 || stdout != "building\n" {
+		t.Errorf("Expected plain ahoy to run the default command, actual - %d: %s", code, stdout)
+	}
+
+	stdout, stderr, code := runMain(t, "-f", "testdata/bad-default.ahoy.yml")
+	if code == 0 || !strings.Contains(stdout, "COMMANDS:") {
+		t.Errorf("Expected plain ahoy to show help for a missing default command, actual - %d: %s", code, stdout)
+	}
+	if !strings.Contains(stderr, "[warn] The default command 'missing' doesn't exist.") {
+		t.Errorf("Expected a warning about the missing default command, actual - %s", stderr)
+	}
+}
+
 func TestGetCommands(t *testing.T) {
 	// Get Command with no sub Commands.
-	config := Config{
-		Usage:   "Test getSubCommands Usage.",
+	cfg := Config{
+		Usage:   "Test getCliCommands Usage.",
 		AhoyAPI: "v2",
 		Commands: map[string]Command{
 			"test-command": Command{
@@ -31,13 +1039,23 @@ func TestGetCommands(t *testing.T) {
 		},
 	}
 
-	commands := getCommands(config)
+	commands := getCliCommands(resolveCommands(cfg))
 
 	if len(commands) != 1 {
-		t.Error("Expect that getCommands can get one command if passed config with one command.")
+		t.Error("Expect that getCliCommands can get one command if passed config with one command.")
 	}
 }
 
+// importedCommands resolves includes the way a command's imports are, and
+// returns the cli commands they become.
+func importedCommands(t *testing.T, includes []string) []cli.Command {
+	subCommands, err := config.ResolveImports(AhoyConf.srcDir, includes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return getCliCommands(subCommands)
+}
+
 func TestGetSubCommand(t *testing.T) {
 	// Since we're not running the app directly, sourcedir doesn't get reset, so
 	// we need to reset it ourselves. TODO: Remove these globals somehow.
@@ -45,20 +1063,20 @@ func TestGetSubCommand(t *testing.T) {
 
 	// When empty return empty list of commands.
 
-	actual := getSubCommands([]string{})
+	actual := importedCommands(t, []string{})
 
 	if len(actual) != 0 {
-		t.Error("Expect that getSubCommands([]string) returns []Command{}")
+		t.Error("Expect that importing []string returns []Command{}")
 	}
 
 	// List of bogus or empty strings returns empty list of commands.
-	actual = getSubCommands([]string{
+	actual = importedCommands(t, []string{
 		"./testing/bogus1.ahoy.yml",
 		"./testing/private.ahoy.yml",
 	})
 
 	if len(actual) != 0 {
-		t.Error("Expect that getSubCommands([]string) returns []Command{}")
+		t.Error("Expect that importing []string returns []Command{}")
 	}
 
 	// Commands with same name are merged, last one wins.
@@ -105,7 +1123,7 @@ commands:
 		t.Error("Error writing to file2.")
 	}
 
-	actual = getSubCommands([]string{
+	actual = importedCommands(t, []string{
 		"./testing/a.ahoy.yml",
 		"./testing/b.ahoy.yml",
 	})
@@ -140,7 +1158,7 @@ commands:
 		t.Error("Error writing to file3.")
 	}
 
-	actual = getSubCommands([]string{
+	actual = importedCommands(t, []string{
 		"./testing/a.ahoy.yml",
 		"./testing/b.ahoy.yml",
 		"./testing/c.ahoy.yml",
@@ -173,9 +1191,9 @@ func TestGetConfig(t *testing.T) {
 				Usage:       "test-command",
 				Cmd:         "echo 'Hello World'",
 				Hide:        false,
-				Imports: []string{
-					"./path/a",
-					"./path/b",
+				Imports: []config.Import{
+					{File: "./path/a"},
+					{File: "./path/b", Prefix: "b"},
 				},
 			},
 		},
@@ -206,6 +1224,59 @@ func TestGetConfig(t *testing.T) {
 	os.Remove("test_getConfig.yml")
 }
 
+func TestGetConfigErrors(t *testing.T) {
+	// getConfig returns errors rather than exiting so callers can decide what to do.
+	_, err := getConfig("testdata/bad-version.ahoy.yml")
+	if err == nil || !strings.Contains(err.Error(), "'v1' given in testdata/bad-version.ahoy.yml") {
+		t.Errorf("Expected an error naming the unsupported API version and file, actual - %v", err)
+	}
+
+	_, err = getConfig("testdata/malformed.ahoy.yml")
+	if err == nil {
+		t.Error("Expected an error for malformed YAML.")
+	}
+
+	// A .ahoy.yml that is really a directory isn't reported as missing.
+	dir := t.TempDir()
+	os.Mkdir(dir+"/.ahoy.yml", 0755)
+	_, stderr, code := runMain(t, "-f", dir, "echo")
+	if code == 0 || !strings.Contains(stderr, dir+"/.ahoy.yml is a directory") {
+		t.Errorf("Expected an error saying .ahoy.yml is a directory, actual - %d: %s", code, stderr)
+	}
+
+	file := dir + "/locked.ahoy.yml"
+	ioutil.WriteFile(file, []byte("ahoyapi: v2\n"), 0000)
+	if f, err := os.Open(file); err == nil {
+		f.Close()
+		t.Skip("Skipping the permission check since the file is still readable.")
+	}
+	_, stderr, code = runMain(t, "-f", file, "echo")
+	if code == 0 || !strings.Contains(stderr, "can't be read because of its permissions") {
+		t.Errorf("Expected a permission error for %s, actual - %d: %s", file, code, stderr)
+	}
+}
+
+func TestUnsupportedAPIExitCode(t *testing.T) {
+	_, stderr, code := runMain(t, "-f", "testdata/bad-version.ahoy.yml", "echo")
+	if code != exitUnsupportedAPI {
+		t.Errorf("Expected exit code %d for an unsupported ahoyapi, actual - %d", exitUnsupportedAPI, code)
+	}
+
+	expected := "ahoy: unsupported ahoyapi 'v1' in testdata/bad-version.ahoy.yml\n"
+	if stderr != expected {
+		t.Errorf("Expected stderr to be %q, actual - %q", expected, stderr)
+	}
+
+	// Empty files and files with only comments have no ahoyapi at all.
+	for _, file := range []string{"testdata/empty.ahoy.yml", "testdata/comments-only.ahoy.yml"} {
+		_, stderr, code = runMain(t, "-f", file, "echo")
+		expected = "ahoy: config file " + file + " is empty or missing 'ahoyapi: v2'\n"
+		if code != exitUnsupportedAPI || stderr != expected {
+			t.Errorf("Expected %q, actual - %d: %q", expected, code, stderr)
+		}
+	}
+}
+
 func TestGetConfigPath(t *testing.T) {
 	// Passinng empty string.
 	pwd, _ := os.Getwd()
@@ -223,7 +1294,167 @@ func TestGetConfigPath(t *testing.T) {
 		t.Errorf("ahoy docker override-example: expected - %s; actual - %s", string(expected), string(actual))
 	}
 
-	// TODO: Passing directory should return default
+	// Passing a directory returns the .ahoy.yml inside it.
+	actual, _ = getConfigPath(pwd)
+	if expected != actual {
+		t.Errorf("getConfigPath(%s): expected - %s; actual - %s", pwd, expected, actual)
+	}
+
+	// Passing a directory without a .ahoy.yml names the directory.
+	dir := t.TempDir()
+	actual, err := getConfigPath(dir)
+	if err == nil || !strings.Contains(err.Error(), dir) {
+		t.Errorf("getConfigPath(%s): expected an error naming the directory; actual - %s, %v", dir, actual, err)
+	}
+}
+
+func TestGetConfigPathTrace(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	verbose = true
+	defer func() { verbose = false }()
+
+	pwd, _ := os.Getwd()
+	dir := pwd + "/testdata/config/nested"
+	os.MkdirAll(dir, 0755)
+	defer os.RemoveAll(pwd + "/testdata/config")
+	os.Chdir(dir)
+	defer os.Chdir(pwd)
+
+	actual, _ := getConfigPath("")
+	if actual != pwd+"/.ahoy.yml" {
+		t.Errorf("getConfigPath: expected - %s; actual - %s", pwd+"/.ahoy.yml", actual)
+	}
+	for _, walked := range []string{dir, pwd + "/testdata/config", pwd + "/testdata", pwd} {
+		if !strings.Contains(buf.String(), "[debug] Looking for .ahoy.yml in "+walked+"\n") {
+			t.Errorf("Expected the trace to mention %s, actual - %s", walked, buf.String())
+		}
+	}
+	if !strings.Contains(buf.String(), "[debug] Found .ahoy.yml at "+pwd+"/.ahoy.yml") {
+		t.Errorf("Expected the trace to mention the selected file, actual - %s", buf.String())
+	}
+}
+
+func TestExplain(t *testing.T) {
+	pwd, _ := os.Getwd()
+	stdout, _, code := runMain(t, "-f", "testdata/nested-commands.ahoy.yml", "--explain", "docker", "build", "fast")
+	if code != 0 {
+		t.Errorf("Expected --explain to succeed, actual - %d", code)
+	}
+	for _, expected := range []string{
+		"command: docker build\n",
+		"file: " + pwd + "/testdata/nested-commands.ahoy.yml\n",
+		"shell: bash\n",
+		`command line: bash -c 'echo "Building images."' build fast` + "\n",
+	} {
+		if !strings.Contains(stdout, expected) {
+			t.Errorf("Expected --explain to show %q, actual - %s", expected, stdout)
+		}
+	}
+
+	stdout, _, _ = runMain(t, "-f", "testdata/nested-commands.ahoy.yml", "--explain", "--json", "docker", "build")
+	var e explanation
+	if err := json.Unmarshal([]byte(stdout), &e); err != nil || e.Shell != "bash" || e.File != pwd+"/testdata/nested-commands.ahoy.yml" {
+		t.Errorf("Expected --explain --json to describe the command, actual - %s", stdout)
+	}
+}
+
+func TestPrintConfigPath(t *testing.T) {
+	pwd, _ := os.Getwd()
+	stdout, _, code := runMain(t, "--print-config-path", "-f", "testdata/simple.ahoy.yml")
+	if code != 0 || stdout != pwd+"/testdata/simple.ahoy.yml\n" {
+		t.Errorf("Expected --print-config-path to print the absolute path, actual - %d: %s", code, stdout)
+	}
+
+	stdout, _, code = runMain(t, "--print-config-path", "--cwd", t.TempDir())
+	if code == 0 || stdout != "" {
+		t.Errorf("Expected --print-config-path to fail without an ahoy file, actual - %d: %s", code, stdout)
+	}
+}
+
+func TestConfigFromStdin(t *testing.T) {
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	r, w, _ := os.Pipe()
+	os.Stdin = r
+
+	w.Write([]byte(`
+ahoyapi: v2
+commands:
+  piped:
+    cmd: echo "piped config"
+`))
+	w.Close()
+
+	expected := "piped config\n"
+	actual, _ := appRun([]string{"ahoy", "-f", "-", "piped"})
+	if expected != actual {
+		t.Errorf("ahoy -f - piped: expected - %s; actual - %s", string(expected), string(actual))
+	}
+}
+
+func TestCwdFlag(t *testing.T) {
+	pwd, _ := os.Getwd()
+	defer os.Chdir(pwd)
+
+	// Relative -f paths resolve against --cwd.
+	expected := "from cwd\n"
+	actual, _ := appRun([]string{"ahoy", "--cwd", "testdata", "-f", "simple.ahoy.yml", "echo", "from cwd"})
+	if expected != actual {
+		t.Errorf("ahoy --cwd testdata -f simple.ahoy.yml echo: expected - %s; actual - %s", string(expected), string(actual))
+	}
+	os.Chdir(pwd)
+
+	// Without -f, the config is discovered from --cwd.
+	project := t.TempDir()
+	projectYaml := `
+ahoyapi: v2
+commands:
+  where:
+    cmd: pwd
+`
+	if err := ioutil.WriteFile(project+"/.ahoy.yml", []byte(projectYaml), 0644); err != nil {
+		t.Fatal("Error writing the project ahoy file.")
+	}
+	expected = project + "\n"
+	actual, _ = appRun([]string{"ahoy", "--cwd", project, "where"})
+	if expected != actual {
+		t.Errorf("ahoy --cwd %s where: expected - %s; actual - %s", project, string(expected), string(actual))
+	}
+	os.Chdir(pwd)
+
+	// Run puts the working directory back once it's done.
+	if code := Run([]string{"ahoy", "--cwd", project, "where"}); code != 0 {
+		t.Errorf("Expected Run with --cwd to pass, actual - %d", code)
+	}
+	if actual, _ := os.Getwd(); actual != pwd {
+		t.Errorf("Expected Run to restore the working directory to %s, actual - %s", pwd, actual)
+	}
+}
+
+func TestConfigPathFromHome(t *testing.T) {
+	home := t.TempDir()
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+	os.Setenv("AHOY_TEST_PROJECT", "project")
+	defer os.Unsetenv("AHOY_TEST_PROJECT")
+	os.MkdirAll(home+"/project", 0755)
+	if err := ioutil.WriteFile(home+"/project/somefile.ahoy.yml", []byte("ahoyapi: v2\ncommands:\n  hi:\n    cmd: echo hi\n"), 0644); err != nil {
+		t.Fatal("Error writing the ahoy file.")
+	}
+
+	for _, file := range []string{"~/project/somefile.ahoy.yml", "$HOME/project/somefile.ahoy.yml", "~/${AHOY_TEST_PROJECT}/somefile.ahoy.yml"} {
+		path, err := getConfigPath(file)
+		if err != nil || path != home+"/project/somefile.ahoy.yml" {
+			t.Errorf("Expected -f %s to be found in the home directory, actual - %s, %v", file, path, err)
+		}
+	}
+
+	stdout, _, code := runMain(t, "-f", "~/project/somefile.ahoy.yml", "hi")
+	if code != 0 || stdout != "hi\n" {
+		t.Errorf("Expected ahoy -f ~/project/somefile.ahoy.yml hi to run, actual - %d: %s", code, stdout)
+	}
 }
 
 func TestGetConfigPathErrorOnBogusPath(t *testing.T) {
@@ -233,6 +1464,187 @@ func TestGetConfigPathErrorOnBogusPath(t *testing.T) {
 	}
 }
 
+func TestDiagnosticsGoToStderr(t *testing.T) {
+	stdout, stderr, _ := runMain(t, "--verbose", "-f", "testdata/simple.ahoy.yml", "echo", "hello")
+	if stdout != "hello\n" {
+		t.Errorf("Expected only the command's output on stdout, actual - %s", stdout)
+	}
+	if !strings.Contains(stderr, "===> AHOY echo") {
+		t.Errorf("Expected the verbose trace on stderr, actual - %s", stderr)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ahoyapi: v2\n")
+	}))
+	defer server.Close()
+	stdout, stderr, _ = runMain(t, "-f", "testdata/simple.ahoy.yml", "init", "-o", t.TempDir()+"/.ahoy.yml", server.URL)
+	if stdout != "" || !strings.Contains(stderr, "example.ahoy.yml downloaded to") {
+		t.Errorf("Expected the init message on stderr only, actual stdout - %s; stderr - %s", stdout, stderr)
+	}
+}
+
+func TestPrefixFlag(t *testing.T) {
+	stdout, stderr, _ := runMain(t, "--prefix", "-f", "testdata/prefix.ahoy.yml", "build")
+	// A last line without a newline is ended so the prefixes stay lined up.
+	if stdout != "[build] one\n[build] three\n" {
+		t.Errorf("Expected stdout lines to be prefixed, actual - %q", stdout)
+	}
+	if stderr != "[build] two\n" {
+		t.Errorf("Expected stderr lines to be prefixed, actual - %q", stderr)
+	}
+
+	stdout, _, _ = runMain(t, "-f", "testdata/prefix.ahoy.yml", "build")
+	if stdout != "one\nthree" {
+		t.Errorf("Expected output without --prefix to be unchanged, actual - %q", stdout)
+	}
+}
+
+func TestTimeFlag(t *testing.T) {
+	stdout, stderr, _ := runMain(t, "--time", "-f", "testdata/simple.ahoy.yml", "echo", "hello")
+	if stdout != "hello\n" {
+		t.Errorf("Expected the command's output on stdout, actual - %s", stdout)
+	}
+	if !regexp.MustCompile(`^command 'echo' took \d+\.\d\ds\n$`).MatchString(stderr) {
+		t.Errorf("Expected a timing line on stderr, actual - %s", stderr)
+	}
+
+	_, stderr, _ = runMain(t, "-f", "testdata/simple.ahoy.yml", "echo", "hello")
+	if stderr != "" {
+		t.Errorf("Expected no timing line without --time, actual - %s", stderr)
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func() { logLevel = "info" }()
+
+	logLevel = "warn"
+	logger("info", "info message")
+	logger("error", "error message")
+	if strings.Contains(buf.String(), "info message") {
+		t.Error("Expected info messages to be filtered out at the warn level.")
+	}
+	if !strings.Contains(buf.String(), "[error] error message") {
+		t.Errorf("Expected error messages to be logged at the warn level, actual - %s", buf.String())
+	}
+
+	// --verbose always logs debug messages.
+	buf.Reset()
+	verbose = true
+	logger("debug", "debug message")
+	verbose = false
+	if !strings.Contains(buf.String(), "[debug] debug message") {
+		t.Errorf("Expected debug messages to be logged when verbose, actual - %s", buf.String())
+	}
+}
+
+func TestLoggerJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer func() { logFormat = "text" }()
+
+	logFormat = "json"
+	logger("error", "something broke")
+
+	var entry logEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("Expected one JSON object per line, actual - %s", buf.String())
+	}
+	if entry.Level != "error" || entry.Message != "something broke" || entry.Time == "" {
+		t.Errorf("Expected level, message and time to be set, actual - %+v", entry)
+	}
+}
+
+func TestInitOutput(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ahoyapi: v2\n")
+	}))
+	defer server.Close()
+
+	output := t.TempDir() + "/build/nested/.ahoy.yml"
+	appRun([]string{"ahoy", "-f", "testdata/simple.ahoy.yml", "init", "-o", output, server.URL})
+
+	actual, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal("Expected init to create the nested output path:", err)
+	}
+	if string(actual) != "ahoyapi: v2\n" {
+		t.Errorf("ahoy init -o: expected the downloaded file; actual - %s", string(actual))
+	}
+}
+
+func TestInitURLFromEnvironment(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ahoyapi: v2\n# "+r.URL.Path+"\n")
+	}))
+	defer server.Close()
+	os.Setenv("AHOY_INIT_URL", server.URL+"/from-env")
+	defer os.Unsetenv("AHOY_INIT_URL")
+
+	output := t.TempDir() + "/.ahoy.yml"
+	appRun([]string{"ahoy", "-f", "testdata/simple.ahoy.yml", "init", "-o", output})
+	actual, _ := ioutil.ReadFile(output)
+	if string(actual) != "ahoyapi: v2\n# /from-env\n" {
+		t.Errorf("ahoy init: expected the file from AHOY_INIT_URL; actual - %s", string(actual))
+	}
+
+	// An explicit URL still wins.
+	appRun([]string{"ahoy", "-f", "testdata/simple.ahoy.yml", "init", "-o", output, server.URL + "/from-arg"})
+	actual, _ = ioutil.ReadFile(output)
+	if string(actual) != "ahoyapi: v2\n# /from-arg\n" {
+		t.Errorf("ahoy init <url>: expected the file from the argument; actual - %s", string(actual))
+	}
+}
+
+func TestInitStdout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ahoyapi: v2\n")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	stdout, _, code := runMain(t, "--cwd", dir, "init", "--stdout", server.URL)
+	if code != 0 || stdout != "ahoyapi: v2\n" {
+		t.Errorf("ahoy init --stdout: expected the template on stdout; actual - %d: %s", code, stdout)
+	}
+	if _, err := os.Stat(dir + "/.ahoy.yml"); err == nil {
+		t.Error("ahoy init --stdout: expected no .ahoy.yml to be written.")
+	}
+
+	_, _, code = runMain(t, "--cwd", dir, "init", "--stdout", "-o", "out.yml", server.URL)
+	if code == 0 {
+		t.Error("ahoy init --stdout -o: expected an error as only one can be used.")
+	}
+}
+
+// runMain runs ahoy with args in a separate process, returning its output
+// and exit code.
+func runMain(t *testing.T, args ...string) (string, string, int) {
+	var stdout, stderr bytes.Buffer
+	cmd := mainCommand(&stdout, &stderr, args...)
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), stderr.String(), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal("Couldn't run ahoy:", err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// mainCommand returns the process that runMain uses to run ahoy with args.
+func mainCommand(stdout io.Writer, stderr io.Writer, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMain$")
+	// The args are JSON encoded so that args with newlines survive.
+	mainArgs, _ := json.Marshal(args)
+	cmd.Env = append(os.Environ(), "AHOY_TEST_MAIN_ARGS="+string(mainArgs))
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd
+}
+
 func appRun(args []string) (string, error) {
 	stdout := os.Stdout
 	r, w, _ := os.Pipe()
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ahoy-cli/ahoy/config"
+)
+
+// auditRecord is the JSON line written to the audit log for each command
+// that is run.
+type auditRecord struct {
+	Time     string   `json:"time"`
+	Command  string   `json:"command"`
+	Cmd      string   `json:"cmd,omitempty"`
+	Args     []string `json:"args,omitempty"`
+	ExitCode int      `json:"exit_code"`
+	Duration float64  `json:"duration_seconds"`
+}
+
+// getAuditLogPath returns the file commands are logged to, from
+// $AHOY_AUDIT_LOG or the ahoy file's audit_log, or "" when auditing is off.
+func getAuditLogPath() string {
+	if path := os.Getenv("AHOY_AUDIT_LOG"); path != "" {
+		return path
+	}
+	if AhoyConf.auditLog == "" || filepath.IsAbs(AhoyConf.auditLog) {
+		return AhoyConf.auditLog
+	}
+	return filepath.Join(AhoyConf.srcDir, AhoyConf.auditLog)
+}
+
+// writeAuditRecord appends a record of cmd having run to the audit log at
+// path. Failing to write it only logs a warning, so it never fails the
+// command.
+func writeAuditRecord(path string, cmd config.ResolvedCommand, args []string, start time.Time, err error) {
+	record := auditRecord{
+		Time:     start.Format(time.RFC3339),
+		Command:  cmd.Name,
+		Cmd:      cmd.Cmd,
+		Args:     args,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		record.ExitCode = getExitCode(err)
+	}
+	line, _ := json.Marshal(record)
+
+	f, writeErr := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if writeErr == nil {
+		_, writeErr = f.Write(append(line, '\n'))
+		if closeErr := f.Close(); writeErr == nil {
+			writeErr = closeErr
+		}
+	}
+	if writeErr != nil {
+		logger("warn", "Couldn't write to the audit log "+path+": "+writeErr.Error())
+	}
+}
@@ -0,0 +1,841 @@
+// Package config loads ahoy.yml files and resolves their commands, including
+// imports and nested command groups, without any of the cli wiring. This lets
+// other Go tools reuse ahoy's merging and validation rules.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config handles the overall configuration in an ahoy.yml file
+// with one Config per file.
+type Config struct {
+	Usage      string
+	AhoyAPI    string
+	Commands   map[string]Command
+	Entrypoint []string
+
+	// UseUserShell runs commands with the user's $SHELL instead of bash,
+	// when Entrypoint isn't set.
+	UseUserShell bool `yaml:"use_user_shell" json:"use_user_shell"`
+
+	// MaxImportDepth overrides how deeply imports can be nested, which is
+	// MaxImportDepth by default.
+	MaxImportDepth int `yaml:"max_import_depth" json:"max_import_depth"`
+
+	// Autoload is a directory, relative to the file, whose *.ahoy.yml files
+	// are all loaded in alphabetical order, like ".ahoy.d".
+	Autoload string
+
+	// Default is the command that is run when ahoy is given no command.
+	Default string
+
+	// Setup is a command that is run once, the first time any command is
+	// run from the file's directory, like installing dependencies.
+	Setup string
+
+	// AuditLog is a file, relative to the ahoy file, that a JSON line is
+	// appended to for every command that is run. $AHOY_AUDIT_LOG wins over it.
+	AuditLog string `yaml:"audit_log" json:"audit_log"`
+
+	// MaskEnv names environment variables, or regular expressions matching
+	// their whole names, whose values are shown as *** in ahoy's own output,
+	// like --verbose and --explain.
+	MaskEnv []string `yaml:"mask_env" json:"mask_env"`
+
+	// HelpTemplate replaces the Go template used for ahoy's main help
+	// output. It is rendered with the cli App, like the default one.
+	HelpTemplate string `yaml:"help_template" json:"help_template"`
+
+	// Templates are commands that are never run themselves, but can be
+	// used as YAML anchors or by a command's Extends.
+	Templates map[string]Command `yaml:"x-templates" json:"x-templates"`
+
+	// ImportBase overrides the directory that relative imports are resolved
+	// against. A relative ImportBase is itself relative to Dir.
+	ImportBase string `yaml:"import_base" json:"import_base"`
+
+	// MinAhoy is the oldest ahoy version that the file works with, like
+	// "v2.4.0". MinAhoyVersion is another name for it, which is clearer at
+	// the top of a project's main file.
+	MinAhoy        string `yaml:"min_ahoy" json:"min_ahoy"`
+	MinAhoyVersion string `yaml:"min_ahoy_version" json:"min_ahoy_version"`
+
+	// Errexit makes this file's bash and sh commands exit on the first
+	// failure, unset variable or failed pipeline stage.
+	Errexit bool
+
+	// Dir is the directory that imports are resolved against. Load sets it
+	// to the directory of the loaded file.
+	Dir string `yaml:"-" json:"-"`
+
+	// File is the path the config was loaded from, or "-" for stdin.
+	File string `yaml:"-" json:"-"`
+}
+
+// Command is an ahoy command detailed in ahoy.yml files. Multiple
+// commands can be defined per ahoy.yml file.
+type Command struct {
+	Description string
+	Usage       string
+	Cmd         string
+	Hide        bool
+	Imports     []Import
+	Commands    map[string]Command
+
+	// Summary and Help are clearer names for Usage and Description. When
+	// set, they replace them.
+	Summary string
+	Help    string
+
+	// Arguments document the arguments a command takes. They make up the
+	// command's usage line and are listed by 'ahoy --help <command>'.
+	Arguments []Argument
+
+	// Examples are shown under EXAMPLES by 'ahoy --help <command>'.
+	Examples []string
+
+	// Time prints how long the command took once it finishes.
+	Time bool
+
+	// Complete is run like Cmd to complete the command's arguments, with
+	// each line it prints offered as a value.
+	Complete string
+
+	// HideIf and ShowIf name an environment variable, like "$CI", that hides
+	// or shows the command depending on whether it's set to a truthy value.
+	HideIf string `yaml:"hide_if" json:"hide_if"`
+	ShowIf string `yaml:"show_if" json:"show_if"`
+
+	// Confirm is a question that must be answered yes before the command
+	// runs, like "This will drop the database. Continue?".
+	Confirm string
+
+	// Interactive commands have signals like SIGINT forwarded to them by
+	// ahoy, and the terminal state restored after they exit.
+	Interactive bool
+
+	// Parallel names other commands to run at the same time. The command
+	// fails if any of them fail.
+	Parallel []string
+
+	// Steps names other commands to run one after another, stopping at the
+	// first one that fails unless ContinueOnError is set.
+	Steps           []string
+	ContinueOnError bool `yaml:"continue_on_error" json:"continue_on_error"`
+
+	// Depends names other commands to run first, each at most once per
+	// invocation. The command doesn't run if one of them fails.
+	Depends []string
+
+	// Capture names an environment variable that a step's trimmed stdout is
+	// put in, instead of being printed, for the steps after it.
+	Capture string
+
+	// Inputs and Outputs are file globs, relative to the ahoy file's
+	// directory. When both are set, the command is skipped if every output
+	// is newer than every input, unless ahoy is run with --force.
+	Inputs  []string
+	Outputs []string
+
+	// Watch are file globs, relative to the ahoy file's directory, that
+	// rerun the command when they change with 'ahoy --watch'. Inputs are
+	// watched when it isn't set.
+	Watch []string
+
+	// Extends names another command, or a template, whose fields are used
+	// for any fields this command doesn't set. Bools set to false count as
+	// set, and setting any of cmd, imports, commands, parallel or steps
+	// replaces all of them.
+	Extends string
+
+	// setBools holds the bool fields the file set, so that extends can tell
+	// false apart from not set.
+	setBools map[string]bool
+}
+
+// boolFields are the keys of Command's bool fields, as written in files.
+var boolFields = []string{"hide", "time", "interactive", "continue_on_error"}
+
+// UnmarshalYAML reads a command, noting which of its bool fields are set.
+func (c *Command) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Command
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	var keys map[string]interface{}
+	unmarshal(&keys)
+	for key := range keys {
+		c.noteBool(key)
+	}
+	return nil
+}
+
+// UnmarshalJSON reads a command, noting which of its bool fields are set.
+func (c *Command) UnmarshalJSON(data []byte) error {
+	type plain Command
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	var keys map[string]json.RawMessage
+	json.Unmarshal(data, &keys)
+	for key := range keys {
+		c.noteBool(key)
+	}
+	return nil
+}
+
+// noteBool records key as set when it's one of the bool fields.
+func (c *Command) noteBool(key string) {
+	for _, name := range boolFields {
+		if strings.EqualFold(key, name) {
+			if c.setBools == nil {
+				c.setBools = map[string]bool{}
+			}
+			c.setBools[name] = true
+		}
+	}
+}
+
+// kindFields are the fields that decide what kind of command a command is.
+// A command that sets any of them doesn't take the others from what it
+// extends, since they can't be combined.
+var kindFields = []string{"Cmd", "Imports", "Commands", "Parallel", "Steps"}
+
+// IsHidden reports whether the command should be left out of command
+// listings, taking Hide, HideIf and ShowIf into account.
+func (c Command) IsHidden() bool {
+	if c.Hide || (c.HideIf != "" && envIsTruthy(c.HideIf)) {
+		return true
+	}
+	return c.ShowIf != "" && !envIsTruthy(c.ShowIf)
+}
+
+// envIsTruthy reports whether the environment variable name, with or without
+// a leading $, is set to anything other than "", "0", "false" or "no".
+func envIsTruthy(name string) bool {
+	value := strings.ToLower(os.Getenv(strings.TrimPrefix(name, "$")))
+	return value != "" && value != "0" && value != "false" && value != "no"
+}
+
+// Argument documents one of a command's arguments.
+type Argument struct {
+	Name        string
+	Description string
+	Required    bool
+}
+
+// Import is one of a command's imports: a file, glob pattern or URL. It can
+// be written as just the file, or as an object that also sets a Prefix, like
+// {file: db.ahoy.yml, prefix: db}, which renames the imported commands to
+// db-migrate and so on.
+type Import struct {
+	File   string
+	Prefix string `yaml:",omitempty" json:",omitempty"`
+}
+
+// UnmarshalYAML reads an import written as either a string or an object.
+func (i *Import) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&i.File); err == nil {
+		return nil
+	}
+	type plain Import
+	return unmarshal((*plain)(i))
+}
+
+// MarshalYAML writes imports without a prefix as just the file.
+func (i Import) MarshalYAML() (interface{}, error) {
+	if i.Prefix == "" {
+		return i.File, nil
+	}
+	type plain Import
+	return plain(i), nil
+}
+
+// UnmarshalJSON reads an import written as either a string or an object.
+func (i *Import) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &i.File); err == nil {
+		return nil
+	}
+	type plain Import
+	return json.Unmarshal(data, (*plain)(i))
+}
+
+// ResolvedCommand is a Command after its imports and nested commands have
+// been loaded and merged into Subcommands.
+type ResolvedCommand struct {
+	Command
+	Name        string
+	Entrypoint  []string
+	Errexit     bool
+	File        string
+	Subcommands []ResolvedCommand
+}
+
+// UnsupportedAPIError is returned when a config file's ahoyapi isn't one
+// this version of ahoy supports. Version is empty for files without one,
+// including empty files and files with only comments.
+type UnsupportedAPIError struct {
+	Version string
+	Path    string
+}
+
+func (e *UnsupportedAPIError) Error() string {
+	if e.Version == "" {
+		return "The config file " + e.Path + " is empty or missing 'ahoyapi: v2'"
+	}
+	return "Ahoy only supports API version 'v2', but '" + e.Version + "' given in " + e.Path
+}
+
+// DefaultEntrypoint is used when a config doesn't set its own entrypoint.
+var DefaultEntrypoint = []string{"bash", "-c", "{{cmd}}", "{{name}}"}
+
+// Load reads and parses the ahoy config file at path.
+func Load(path string) (Config, error) {
+	yamlFile, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, readError(path, err)
+	}
+	return Parse(yamlFile, path)
+}
+
+// readError explains why a config file couldn't be read, so a file that
+// exists but can't be opened isn't reported as missing.
+func readError(path string, err error) error {
+	if os.IsPermission(err) {
+		return errors.New("the ahoy config file " + path + " can't be read because of its permissions. Check that you can read it.")
+	}
+	if info, statErr := os.Stat(path); statErr == nil && info.IsDir() {
+		return errors.New("the ahoy config file " + path + " is a directory, not a file. Check your path.")
+	}
+	if os.IsNotExist(err) {
+		return errors.New("an ahoy config file couldn't be found in your path. You can create an example one by using 'ahoy init'")
+	}
+	return err
+}
+
+// decoders unmarshal config files by their file extension. Anything else,
+// including stdin, is read as YAML.
+var decoders = map[string]func(in []byte, out interface{}) error{
+	".yml":  yaml.Unmarshal,
+	".yaml": yaml.Unmarshal,
+	".json": json.Unmarshal,
+}
+
+// Parse parses the contents of an ahoy config file. The path is used to pick
+// the format, to set the config's Dir and in error messages.
+func Parse(data []byte, path string) (Config, error) {
+	var config = Config{}
+
+	decode, ok := decoders[filepath.Ext(path)]
+	if !ok {
+		decode = yaml.Unmarshal
+	}
+
+	// Extract the file into the config varaible.
+	err := decode(data, &config)
+	if err != nil {
+		// A common mistake is writing commands as a list of "- name: build"
+		// entries, which needs a clearer error than the decoder gives.
+		var doc interface{}
+		if decode(data, &doc) == nil {
+			if where, ok := findCommandList(doc, "commands"); ok {
+				err = errors.New("'" + where + "' in " + path + " is a list, but must map command names to commands, like:\n\n" +
+					"commands:\n  build:\n    usage: Build the project.\n    cmd: make build")
+			}
+		}
+		return config, err
+	}
+	config.Dir = filepath.Dir(path)
+	config.File = path
+
+	// All ahoy files (and imports) must specify the ahoy version.
+	// This is so we can support backwards compatability in the future.
+	if config.AhoyAPI != "v2" {
+		err = &UnsupportedAPIError{Version: config.AhoyAPI, Path: path}
+		return config, err
+	}
+
+	if config.MinAhoy == "" {
+		config.MinAhoy = config.MinAhoyVersion
+	}
+
+	if config.Entrypoint == nil {
+		config.Entrypoint = append([]string{}, DefaultEntrypoint...)
+		if config.UseUserShell {
+			config.Entrypoint[0] = userShell()
+		}
+	}
+
+	return config, err
+}
+
+// findCommandList returns the dotted path to the first "commands" key in doc
+// that holds a list, whether doc was decoded from YAML or JSON.
+func findCommandList(doc interface{}, where string) (string, bool) {
+	commands := map[string]interface{}{}
+	switch doc := doc.(type) {
+	case map[interface{}]interface{}:
+		if c, ok := doc["commands"].(map[interface{}]interface{}); ok {
+			for name, cmd := range c {
+				if name, ok := name.(string); ok {
+					commands[name] = cmd
+				}
+			}
+		} else if _, ok := doc["commands"].([]interface{}); ok {
+			return where, true
+		}
+	case map[string]interface{}:
+		if c, ok := doc["commands"].(map[string]interface{}); ok {
+			commands = c
+		} else if _, ok := doc["commands"].([]interface{}); ok {
+			return where, true
+		}
+	}
+
+	// Nested command groups can make the same mistake.
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if nested, ok := findCommandList(commands[name], where+"."+name+".commands"); ok {
+			return nested, true
+		}
+	}
+	return "", false
+}
+
+// userShell returns the user's $SHELL, or bash when it isn't set or can't be
+// found.
+func userShell() string {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		return DefaultEntrypoint[0]
+	}
+	if _, err := exec.LookPath(shell); err != nil {
+		Warn("$SHELL is set to " + shell + ", which can't be found, so " + DefaultEntrypoint[0] + " is used instead.")
+		return DefaultEntrypoint[0]
+	}
+	return shell
+}
+
+// Resolve validates the commands in cfg and resolves their imports and nested
+// command groups, returning the commands sorted by name. Commands from the
+// Autoload directory are merged in underneath cfg's own commands.
+func Resolve(cfg Config) ([]ResolvedCommand, error) {
+	commands, _, err := ResolveWithUsage(cfg)
+	return commands, err
+}
+
+// ResolveWithUsage is Resolve, also returning the app's usage. That is
+// cfg.Usage, or when it's empty, the usage of the first imported file that
+// sets one, so that a shared file can provide it.
+func ResolveWithUsage(cfg Config) ([]ResolvedCommand, string, error) {
+	chain := importChain{files: []string{cfg.File}, maxDepth: MaxImportDepth, usage: new(string)}
+	if cfg.MaxImportDepth > 0 {
+		chain.maxDepth = cfg.MaxImportDepth
+	}
+	usage := func() string {
+		if cfg.Usage != "" {
+			return cfg.Usage
+		}
+		return *chain.usage
+	}
+	commands, err := resolve(cfg, cfg.importDir(), chain)
+	if err != nil || cfg.Autoload == "" {
+		return commands, usage(), err
+	}
+	autoloaded, err := resolveImports(cfg.Dir, []Import{{File: filepath.Join(cfg.Autoload, "*.ahoy.yml")}}, chain)
+	if err != nil {
+		return commands, usage(), err
+	}
+	return MergeCommands(autoloaded, commands), usage(), nil
+}
+
+// MaxImportDepth is how deeply imports can be nested when a config doesn't
+// set its own max_import_depth.
+var MaxImportDepth = 20
+
+// importChain is the chain of files that led to an import, so that imports
+// nested too deeply, which includes import cycles, can be reported.
+type importChain struct {
+	files    []string
+	maxDepth int
+
+	// usage is set to the usage of the first imported file that has one.
+	usage *string
+}
+
+// add returns the chain with file imported at the end of it, or an error if
+// that nests the imports too deeply.
+func (c importChain) add(file string) (importChain, error) {
+	files := append(append([]string{}, c.files...), file)
+	if len(files)-1 > c.maxDepth {
+		return c, errors.New("Imports are nested more than " + strconv.Itoa(c.maxDepth) + " deep: " + strings.Join(files, " -> ") + ". Check your yaml files for imports that import each other.")
+	}
+	return importChain{files: files, maxDepth: c.maxDepth, usage: c.usage}, nil
+}
+
+// importDir returns the directory that cfg's relative imports are resolved
+// against. A leading ~ in ImportBase is the user's home directory.
+func (cfg Config) importDir() string {
+	if cfg.ImportBase == "" {
+		return cfg.Dir
+	}
+	base := ExpandPath(cfg.ImportBase)
+	if filepath.IsAbs(base) {
+		return base
+	}
+	return filepath.Join(cfg.Dir, base)
+}
+
+// Warn is called with problems that don't stop a config from loading, like
+// imports that are skipped. It does nothing unless it is replaced.
+var Warn = func(msg string) {}
+
+var envPattern = regexp.MustCompile(`\$\{(\w+)\}|\{\{(\w+)\}\}`)
+
+// ExpandEnv replaces ${VAR} and {{VAR}} in path with values from the
+// environment, and returns the names of any variables that aren't set.
+func ExpandEnv(path string) (string, []string) {
+	var unset []string
+	expanded := envPattern.ReplaceAllStringFunc(path, func(match string) string {
+		name := strings.Trim(match, "${}")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			unset = append(unset, name)
+		}
+		return value
+	})
+	return expanded, unset
+}
+
+// ExpandPath replaces a leading ~ in path with the user's home directory,
+// ~name with the home directory of that user, and $VAR or ${VAR} with values
+// from the environment, for paths that didn't go through a shell, like quoted
+// ones. A ~name for a user that can't be found is left as it is.
+func ExpandPath(path string) string {
+	path = os.ExpandEnv(path)
+	if !strings.HasPrefix(path, "~") {
+		return path
+	}
+	name, rest := path[1:], ""
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	if name == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = home + rest
+		}
+		return path
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		Warn("Couldn't find the home directory of user '" + name + "', so " + path + " is used as it is.")
+		return path
+	}
+	return u.HomeDir + rest
+}
+
+// ResolveImports loads each of the import files or glob patterns, relative to
+// dir, and merges their commands. When several files define the same command,
+// the last one wins. Imports that match no files are skipped. Imports can
+// also be http(s) URLs, which are downloaded and cached. ${VAR} and {{VAR}}
+// in imports are replaced from the environment, and imports using variables
+// that aren't set are skipped with a warning.
+func ResolveImports(dir string, imports []string) ([]ResolvedCommand, error) {
+	var files []Import
+	for _, file := range imports {
+		files = append(files, Import{File: file})
+	}
+	return resolveImports(dir, files, importChain{maxDepth: MaxImportDepth, usage: new(string)})
+}
+
+// resolveImports does the work of ResolveImports, with chain being the files
+// that led to these imports.
+func resolveImports(dir string, imports []Import, chain importChain) ([]ResolvedCommand, error) {
+	subCommands := []ResolvedCommand{}
+	if 0 == len(imports) {
+		return subCommands, nil
+	}
+	var lists [][]ResolvedCommand
+	for _, imported := range imports {
+		include := imported.File
+		if len(include) == 0 {
+			continue
+		}
+		expanded, unset := ExpandEnv(include)
+		if len(unset) > 0 {
+			Warn("Skipping import [" + include + "] because " + strings.Join(unset, ", ") + " isn't set.")
+			continue
+		}
+		include = expanded
+		if isRemote(include) {
+			cached, err := fetchRemoteImport(include)
+			if err != nil {
+				return subCommands, err
+			}
+			if cached == "" {
+				continue
+			}
+			include = cached
+		} else if include[0] == '~' {
+			include = ExpandPath(include)
+		} else if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+		// Imports can be glob patterns. Matches are loaded in sorted order so
+		// that the last one wins predictably.
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			return subCommands, errors.New("Import [" + include + "] is not a valid glob pattern.")
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			if _, err := os.Stat(match); err != nil {
+				//Skipping files that cannot be loaded allows us to separate
+				//subcommands into public and private.
+				continue
+			}
+			importCfg, err := Load(match)
+			if err != nil {
+				Warn("Import [" + match + "] couldn't be loaded, so it is skipped: " + err.Error())
+				continue
+			}
+			if err := checkMinAhoy(importCfg, "Import ["+match+"]"); err != nil {
+				return subCommands, err
+			}
+			if *chain.usage == "" {
+				*chain.usage = importCfg.Usage
+			}
+			includeChain, err := chain.add(match)
+			if err != nil {
+				return subCommands, err
+			}
+			includeCommands, err := resolve(importCfg, dir, includeChain)
+			if err != nil {
+				return subCommands, err
+			}
+			// A file that loads but has no commands is usually a mistake,
+			// like wrong indentation, that would otherwise go unnoticed.
+			if len(importCfg.Commands) == 0 {
+				Warn("Import [" + match + "] has no commands. Check that they're indented under 'commands:'.")
+			}
+			if imported.Prefix != "" {
+				for i := range includeCommands {
+					includeCommands[i].Name = imported.Prefix + "-" + includeCommands[i].Name
+				}
+			}
+			lists = append(lists, includeCommands)
+		}
+	}
+	return MergeCommands(lists...), nil
+}
+
+// MergeCommands merges lists of resolved commands into one list sorted by
+// name. When more than one list has a command with the same name, the later
+// list wins.
+func MergeCommands(lists ...[]ResolvedCommand) []ResolvedCommand {
+	merged := []ResolvedCommand{}
+	commands := map[string]ResolvedCommand{}
+	for _, list := range lists {
+		for _, command := range list {
+			commands[command.Name] = command
+		}
+	}
+
+	var names []string
+	for k := range commands {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		merged = append(merged, commands[name])
+	}
+	return merged
+}
+
+// resolve does the work of Resolve, with imports always resolved relative to
+// the directory of the root config.
+func resolve(cfg Config, dir string, chain importChain) ([]ResolvedCommand, error) {
+	resolved := []ResolvedCommand{}
+
+	var keys []string
+	for k := range cfg.Commands {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, name := range keys {
+		cmd, err := extend(cfg, name, cfg.Commands[name], nil)
+		if err != nil {
+			return resolved, err
+		}
+
+		// Check that a command has 'cmd', 'imports', nested 'commands', 'parallel' OR 'steps' set.
+		if cmd.Cmd == "" && cmd.Imports == nil && cmd.Commands == nil && cmd.Parallel == nil && cmd.Steps == nil {
+			return resolved, errors.New("Command [" + name + "] has neither 'cmd' or 'imports' set. Check your yaml file.")
+		}
+
+		// Check that a command has 'cmd' OR 'imports' set.
+		if cmd.Cmd != "" && cmd.Imports != nil {
+			return resolved, errors.New("Command [" + name + "] has both 'cmd' and 'imports' set, but only one is allowed. Check your yaml file.")
+		}
+
+		// Nested 'commands' are a group, so they can't be combined with 'cmd' or 'imports'.
+		if cmd.Commands != nil && (cmd.Cmd != "" || cmd.Imports != nil) {
+			return resolved, errors.New("Command [" + name + "] has 'commands' set along with 'cmd' or 'imports', but only one is allowed. Check your yaml file.")
+		}
+
+		// 'parallel' runs other commands, so it can't be combined with anything else.
+		if cmd.Parallel != nil && (cmd.Cmd != "" || cmd.Imports != nil || cmd.Commands != nil) {
+			return resolved, errors.New("Command [" + name + "] has 'parallel' set along with 'cmd', 'imports' or 'commands', but only one is allowed. Check your yaml file.")
+		}
+
+		if cmd.Parallel != nil && len(cmd.Parallel) == 0 {
+			return resolved, errors.New("Command [" + name + "] has 'parallel' set, but it is empty. Check your yaml file.")
+		}
+
+		if cmd.Steps != nil && (cmd.Cmd != "" || cmd.Imports != nil || cmd.Commands != nil || cmd.Parallel != nil) {
+			return resolved, errors.New("Command [" + name + "] has 'steps' set along with 'cmd', 'imports', 'commands' or 'parallel', but only one is allowed. Check your yaml file.")
+		}
+
+		if cmd.Depends != nil && len(cmd.Depends) == 0 {
+			return resolved, errors.New("Command [" + name + "] has 'depends' set, but it is empty. Check your yaml file.")
+		}
+
+		if cmd.Steps != nil && len(cmd.Steps) == 0 {
+			return resolved, errors.New("Command [" + name + "] has 'steps' set, but it is empty. Check your yaml file.")
+		}
+
+		// Check that a command with 'imports' set has a least one entry.
+		if cmd.Imports != nil && len(cmd.Imports) == 0 {
+			return resolved, errors.New("Command [" + name + "] has 'imports' set, but it is empty. Check your yaml file.")
+		}
+
+		if cmd.Summary != "" {
+			cmd.Usage = cmd.Summary
+		}
+		if cmd.Help != "" {
+			cmd.Description = cmd.Help
+		}
+
+		newCmd := ResolvedCommand{
+			Command:    cmd,
+			Name:       name,
+			Entrypoint: cfg.Entrypoint,
+			Errexit:    cfg.Errexit,
+			File:       cfg.File,
+		}
+		if newCmd.Entrypoint == nil {
+			newCmd.Entrypoint = DefaultEntrypoint
+		}
+
+		if cmd.Imports != nil {
+			subCommands, err := resolveImports(dir, cmd.Imports, chain)
+			if err != nil {
+				return resolved, err
+			}
+			if len(subCommands) == 0 {
+				return resolved, errors.New("Command [" + name + "] has 'imports' set, but no commands were found. Check your yaml file.")
+			}
+			newCmd.Subcommands = subCommands
+		}
+
+		// Inline command groups share the entrypoint of the file they're defined in.
+		if cmd.Commands != nil {
+			if len(cmd.Commands) == 0 {
+				return resolved, errors.New("Command [" + name + "] has 'commands' set, but it is empty. Check your yaml file.")
+			}
+			subCommands, err := resolve(Config{
+				Entrypoint: newCmd.Entrypoint,
+				Errexit:    cfg.Errexit,
+				File:       cfg.File,
+				Commands:   cmd.Commands,
+				Templates:  cfg.Templates,
+			}, dir, chain)
+			if err != nil {
+				return resolved, err
+			}
+			newCmd.Subcommands = subCommands
+		}
+
+		resolved = append(resolved, newCmd)
+	}
+
+	return resolved, nil
+}
+
+// extend fills in any fields that cmd doesn't set from the command or
+// template it extends, following chains of extends. seen holds the names
+// already visited so that cycles are reported instead of looping forever.
+func extend(cfg Config, name string, cmd Command, seen []string) (Command, error) {
+	if cmd.Extends == "" {
+		return cmd, nil
+	}
+	for _, s := range seen {
+		if s == name {
+			return cmd, errors.New("Command [" + name + "] extends itself through [" + strings.Join(seen, " -> ") + "]. Check your yaml file.")
+		}
+	}
+
+	base, ok := cfg.Commands[cmd.Extends]
+	if !ok {
+		base, ok = cfg.Templates[cmd.Extends]
+	}
+	if !ok {
+		return cmd, errors.New("Command [" + name + "] extends [" + cmd.Extends + "], but it doesn't exist. Check your yaml file.")
+	}
+	base, err := extend(cfg, cmd.Extends, base, append(seen, name))
+	if err != nil {
+		return cmd, err
+	}
+
+	extended := reflect.ValueOf(&cmd).Elem()
+	defaults := reflect.ValueOf(base)
+	skip := map[string]bool{}
+	for _, name := range kindFields {
+		if !extended.FieldByName(name).IsZero() {
+			for _, kind := range kindFields {
+				skip[kind] = true
+			}
+		}
+	}
+	for i := 0; i < extended.NumField(); i++ {
+		field := extended.Type().Field(i)
+		if field.PkgPath != "" || skip[field.Name] {
+			continue
+		}
+		// A bool set to false in the file overrides a true one.
+		if field.Type.Kind() == reflect.Bool && cmd.setBools[boolKey(field)] {
+			continue
+		}
+		if extended.Field(i).IsZero() {
+			extended.Field(i).Set(defaults.Field(i))
+		}
+	}
+	return cmd, nil
+}
+
+// boolKey returns the key that a bool field of Command is written as.
+func boolKey(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("yaml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(field.Name)
+}
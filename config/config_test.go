@@ -0,0 +1,480 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load("testdata/root.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+
+	if cfg.Usage != "Root config with imports." {
+		t.Errorf("Expected cfg.Usage to be loaded, but actual is %s", cfg.Usage)
+	}
+
+	if cfg.Dir != "testdata" {
+		t.Errorf("Expected cfg.Dir to be testdata, but actual is %s", cfg.Dir)
+	}
+
+	if !reflect.DeepEqual(cfg.Entrypoint, DefaultEntrypoint) {
+		t.Errorf("Expected the default entrypoint, but actual is %v", cfg.Entrypoint)
+	}
+
+	if _, err := Load("testdata/bogus.ahoy.yml"); err == nil {
+		t.Error("Expected Load to fail for a missing file.")
+	}
+}
+
+func TestLoadReadErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Load(dir)
+	if err == nil || !strings.Contains(err.Error(), dir+" is a directory") {
+		t.Errorf("Expected an error saying %s is a directory, actual - %v", dir, err)
+	}
+
+	_, err = Load(dir + "/missing.ahoy.yml")
+	if err == nil || !strings.Contains(err.Error(), "couldn't be found") {
+		t.Errorf("Expected a not found error, actual - %v", err)
+	}
+
+	file := dir + "/locked.ahoy.yml"
+	if err := ioutil.WriteFile(file, []byte("ahoyapi: v2\n"), 0000); err != nil {
+		t.Fatal(err)
+	}
+	// Root can read the file anyway, so there's nothing to check.
+	if f, err := os.Open(file); err == nil {
+		f.Close()
+		t.Skip("Skipping the permission check since the file is still readable.")
+	}
+	_, err = Load(file)
+	if err == nil || !strings.Contains(err.Error(), "can't be read because of its permissions") {
+		t.Errorf("Expected a permission error for %s, actual - %v", file, err)
+	}
+}
+
+func TestLoadUserShell(t *testing.T) {
+	var warnings []string
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+	defer func() { Warn = func(msg string) {} }()
+	shell := os.Getenv("SHELL")
+	defer os.Setenv("SHELL", shell)
+
+	os.Setenv("SHELL", "/bin/sh")
+	cfg, err := Load("testdata/user-shell.ahoy.yml")
+	if err != nil || cfg.Entrypoint[0] != "/bin/sh" {
+		t.Errorf("Expected the entrypoint to use $SHELL, but actual is %v, %v", cfg.Entrypoint, err)
+	}
+
+	os.Setenv("SHELL", "/missing/shell")
+	cfg, _ = Load("testdata/user-shell.ahoy.yml")
+	if cfg.Entrypoint[0] != "bash" {
+		t.Errorf("Expected the entrypoint to fall back to bash, but actual is %v", cfg.Entrypoint)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "/missing/shell") {
+		t.Errorf("Expected a warning naming the missing shell, but actual is %v", warnings)
+	}
+
+	// Without use_user_shell, $SHELL is ignored.
+	os.Setenv("SHELL", "/bin/sh")
+	cfg, _ = Load("testdata/root.ahoy.yml")
+	if cfg.Entrypoint[0] != "bash" {
+		t.Errorf("Expected bash without use_user_shell, but actual is %v", cfg.Entrypoint)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	cfg, err := Load("testdata/root.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+
+	commands, err := Resolve(cfg)
+	if err != nil {
+		t.Fatal("Resolve returned an error for a valid config:", err)
+	}
+
+	if len(commands) != 2 || commands[0].Name != "docker" || commands[1].Name != "hello" {
+		t.Fatalf("Expected the docker and hello commands sorted by name, but actual is %+v", commands)
+	}
+
+	docker := commands[0]
+	if len(docker.Subcommands) != 2 {
+		t.Fatalf("Expected imports to be merged into two subcommands, but actual is %+v", docker.Subcommands)
+	}
+
+	build := docker.Subcommands[0]
+	if build.Name != "build" || build.Usage != "Build from b." {
+		t.Errorf("Expected the last import to win for build, but actual is %+v", build)
+	}
+
+	if build.Entrypoint[0] != "sh" {
+		t.Errorf("Expected build to keep the entrypoint of its own file, but actual is %v", build.Entrypoint)
+	}
+}
+
+func TestResolveSummaryAndHelp(t *testing.T) {
+	cfg, err := Load("testdata/summary.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+	commands, err := Resolve(cfg)
+	if err != nil {
+		t.Fatal("Resolve returned an error for a valid config:", err)
+	}
+
+	if commands[0].Name != "new-names" || commands[0].Usage != "Summary sets the usage." || commands[0].Description != "Help sets the description." {
+		t.Errorf("Expected summary and help to set the usage and description, but actual is %+v", commands[0])
+	}
+	if commands[1].Usage != "Usage still works." || commands[1].Description != "So does description." {
+		t.Errorf("Expected usage and description to still work, but actual is %+v", commands[1])
+	}
+}
+
+func TestResolveInvalidCommand(t *testing.T) {
+	cfg := Config{
+		AhoyAPI: "v2",
+		Commands: map[string]Command{
+			"broken": {Usage: "Has neither cmd nor imports."},
+		},
+	}
+
+	if _, err := Resolve(cfg); err == nil {
+		t.Error("Expected Resolve to return an error for a command with neither cmd nor imports.")
+	}
+}
+
+func TestResolveImportBase(t *testing.T) {
+	cfg, err := Load("testdata/generated/import-base.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+
+	commands, err := Resolve(cfg)
+	if err != nil {
+		t.Fatal("Expected imports to resolve against import_base:", err)
+	}
+
+	if len(commands) != 1 || len(commands[0].Subcommands) != 2 {
+		t.Errorf("Expected the commands from testdata/a.ahoy.yml, but actual is %+v", commands)
+	}
+
+	// A base starting with ~ is in the home directory.
+	wd, _ := os.Getwd()
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", wd)
+	cfg.ImportBase = "~/testdata"
+	commands, err = Resolve(cfg)
+	if err != nil || len(commands) != 1 || len(commands[0].Subcommands) != 2 {
+		t.Errorf("Expected imports to resolve against ~/testdata, but actual is %+v, %v", commands, err)
+	}
+}
+
+func TestResolveGlobImports(t *testing.T) {
+	cfg, err := Load("testdata/glob.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+
+	commands, err := Resolve(cfg)
+	if err != nil {
+		t.Fatal("Resolve returned an error for a valid config:", err)
+	}
+
+	library := commands[0].Subcommands
+	if len(library) != 3 {
+		t.Fatalf("Expected the commands from both matched files, but actual is %+v", library)
+	}
+
+	if library[0].Name != "build" || library[0].Usage != "Build from two." {
+		t.Errorf("Expected the last file in sorted order to win for build, but actual is %+v", library[0])
+	}
+}
+
+func TestResolvePrefixedImports(t *testing.T) {
+	cfg, err := Load("testdata/prefix.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+	commands, err := Resolve(cfg)
+	if err != nil {
+		t.Fatal("Resolve returned an error for a valid config:", err)
+	}
+
+	usages := map[string]string{}
+	for _, cmd := range commands[0].Subcommands {
+		usages[cmd.Name] = cmd.Usage
+	}
+	expected := map[string]string{
+		"b-build": "Build from b.",
+		"build":   "Build from a.",
+		"up":      "Start from a.",
+	}
+	if !reflect.DeepEqual(expected, usages) {
+		t.Errorf("Expected the commands from b to be prefixed, but actual is %v", usages)
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	var warnings []string
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+	defer func() { Warn = func(msg string) {} }()
+
+	home, _ := os.UserHomeDir()
+	if actual := ExpandPath("~/project/.ahoy.yml"); actual != home+"/project/.ahoy.yml" {
+		t.Errorf("Expected ~/ to be the home directory, actual - %s", actual)
+	}
+
+	if current, err := user.Current(); err == nil {
+		if actual := ExpandPath("~" + current.Username + "/.ahoy.yml"); actual != current.HomeDir+"/.ahoy.yml" {
+			t.Errorf("Expected ~%s to be %s, actual - %s", current.Username, current.HomeDir, actual)
+		}
+	}
+
+	if actual := ExpandPath("~nonexistent-ahoy-user/.ahoy.yml"); actual != "~nonexistent-ahoy-user/.ahoy.yml" {
+		t.Errorf("Expected an unknown user to be left as it is, actual - %s", actual)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "user 'nonexistent-ahoy-user'") {
+		t.Errorf("Expected a warning naming the unknown user, actual - %v", warnings)
+	}
+}
+
+func TestResolveImportsFromEnv(t *testing.T) {
+	var warnings []string
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+	defer func() { Warn = func(msg string) {} }()
+
+	imports := []string{"library/one.ahoy.yml", "library/${AHOY_TEST_LIBRARY}.ahoy.yml"}
+	os.Setenv("AHOY_TEST_LIBRARY", "two")
+	commands, err := ResolveImports("testdata", imports)
+	if err != nil || len(commands) != 3 || commands[2].Name != "second" {
+		t.Errorf("Expected the import named by AHOY_TEST_LIBRARY to be loaded, but actual is %+v, %v", commands, err)
+	}
+
+	os.Unsetenv("AHOY_TEST_LIBRARY")
+	commands, err = ResolveImports("testdata", imports)
+	if err != nil || len(commands) != 2 {
+		t.Errorf("Expected only the import without variables to be loaded, but actual is %+v, %v", commands, err)
+	}
+	if len(warnings) != 1 || warnings[0] != "Skipping import [library/${AHOY_TEST_LIBRARY}.ahoy.yml] because AHOY_TEST_LIBRARY isn't set." {
+		t.Errorf("Expected a warning naming the unset variable, but actual is %v", warnings)
+	}
+}
+
+func TestResolveImportsWithoutCommands(t *testing.T) {
+	var warnings []string
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+	defer func() { Warn = func(msg string) {} }()
+
+	commands, err := ResolveImports("testdata", []string{"library/one.ahoy.yml", "library/no-commands.ahoy.yml"})
+	if err != nil || len(commands) != 2 {
+		t.Errorf("Expected only the commands from library/one.ahoy.yml, but actual is %+v, %v", commands, err)
+	}
+	expected := "Import [testdata/library/no-commands.ahoy.yml] has no commands. Check that they're indented under 'commands:'."
+	if len(warnings) != 1 || warnings[0] != expected {
+		t.Errorf("Expected a warning naming the file without commands, but actual is %v", warnings)
+	}
+}
+
+func TestResolveImportsThatDontLoad(t *testing.T) {
+	var warnings []string
+	Warn = func(msg string) { warnings = append(warnings, msg) }
+	defer func() { Warn = func(msg string) {} }()
+
+	commands, err := ResolveImports("testdata", []string{"library/one.ahoy.yml", "broken/syntax.ahoy.yml", "broken/version.ahoy.yml"})
+	if err != nil || len(commands) != 2 {
+		t.Errorf("Expected only the commands from library/one.ahoy.yml, but actual is %+v, %v", commands, err)
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("Expected a warning for each import that doesn't load, but actual is %v", warnings)
+	}
+	if !strings.HasPrefix(warnings[0], "Import [testdata/broken/syntax.ahoy.yml] couldn't be loaded") || strings.Contains(warnings[0], "has no commands") {
+		t.Errorf("Expected the YAML error to be reported, but actual is %s", warnings[0])
+	}
+	if !strings.Contains(warnings[1], "'v1' given in testdata/broken/version.ahoy.yml") {
+		t.Errorf("Expected the unsupported version to be reported, but actual is %s", warnings[1])
+	}
+}
+
+func TestResolveWithUsage(t *testing.T) {
+	tests := map[string]string{
+		"testdata/usage/root.ahoy.yml":            "The shared usage.",
+		"testdata/usage/root-with-usage.ahoy.yml": "The project's own usage.",
+	}
+	for path, expected := range tests {
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatal("Load returned an error for a valid config:", err)
+		}
+		commands, usage, err := ResolveWithUsage(cfg)
+		if err != nil || len(commands) != 1 {
+			t.Fatal("ResolveWithUsage returned an error for a valid config:", err)
+		}
+		if usage != expected {
+			t.Errorf("Expected the usage of %s to be %q, but actual is %q", path, expected, usage)
+		}
+	}
+}
+
+func TestResolveAutoload(t *testing.T) {
+	cfg, err := Load("testdata/autoload/.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+	commands, err := Resolve(cfg)
+	if err != nil {
+		t.Fatal("Resolve returned an error for a valid config:", err)
+	}
+
+	usages := map[string]string{}
+	for _, cmd := range commands {
+		usages[cmd.Name] = cmd.Usage
+	}
+	expected := map[string]string{
+		"build":  "Build from the main file, which wins over drop-in files.",
+		"deploy": "Deploy from the second drop-in file, which wins as it sorts later.",
+		"lint":   "Only in the first drop-in file.",
+	}
+	if !reflect.DeepEqual(expected, usages) {
+		t.Errorf("Expected the drop-in files to be merged in order under the main file, but actual is %v", usages)
+	}
+
+	// A missing autoload directory is fine.
+	cfg.Autoload = "missing.d"
+	if commands, err = Resolve(cfg); err != nil || len(commands) != 1 {
+		t.Errorf("Expected only the main file's commands, but actual is %+v, %v", commands, err)
+	}
+}
+
+func TestResolveMaxImportDepth(t *testing.T) {
+	cfg, err := Load("testdata/depth/root.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+	_, err = Resolve(cfg)
+	expected := "testdata/depth/root.ahoy.yml -> testdata/depth/one.ahoy.yml -> testdata/depth/two.ahoy.yml -> testdata/depth/three.ahoy.yml"
+	if err == nil || !strings.Contains(err.Error(), "more than 2 deep: "+expected) {
+		t.Errorf("Expected an error showing the chain of imports, but actual is %v", err)
+	}
+
+	cfg.MaxImportDepth = 3
+	if _, err = Resolve(cfg); err != nil {
+		t.Errorf("Expected imports within the max depth to resolve, but actual is %v", err)
+	}
+
+	// Imports that import each other hit the default max depth instead of
+	// looping forever.
+	cfg, _ = Load("testdata/depth/cycle.ahoy.yml")
+	if _, err = Resolve(cfg); err == nil || !strings.Contains(err.Error(), "more than 20 deep") {
+		t.Errorf("Expected an import cycle to be stopped, but actual is %v", err)
+	}
+}
+
+func TestResolveExtends(t *testing.T) {
+	cfg, err := Load("testdata/extends.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+
+	commands, err := Resolve(cfg)
+	if err != nil {
+		t.Fatal("Resolve returned an error for a valid config:", err)
+	}
+
+	if len(commands) != 3 {
+		t.Fatalf("Expected templates to be left out of the commands, but actual is %+v", commands)
+	}
+
+	build, rebuild, up := commands[0], commands[1], commands[2]
+	if build.Cmd != `docker-compose "$@"` || build.Usage != "Build the containers." {
+		t.Errorf("Expected build to take cmd from its template and keep its own usage, but actual is %+v", build)
+	}
+
+	if rebuild.Cmd != "docker-compose build --no-cache" || rebuild.Usage != "Build the containers." {
+		t.Errorf("Expected rebuild to override cmd and take usage through build, but actual is %+v", rebuild)
+	}
+
+	if up.Cmd != `docker-compose "$@"` || up.Usage != "Start the containers." {
+		t.Errorf("Expected up to merge the template's anchor, but actual is %+v", up)
+	}
+}
+
+func TestResolveExtendsOverrides(t *testing.T) {
+	cfg, err := Load("testdata/extends-override.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid config:", err)
+	}
+
+	commands, err := Resolve(cfg)
+	if err != nil {
+		t.Fatal("Expected a cmd to replace the parallel it extends:", err)
+	}
+
+	byName := map[string]ResolvedCommand{}
+	for _, cmd := range commands {
+		byName[cmd.Name] = cmd
+	}
+	if mine := byName["mine"]; mine.Cmd != `echo "mine"` || len(mine.Parallel) != 0 || mine.Usage != "Run everything." {
+		t.Errorf("Expected mine to keep its cmd and usage without the parallel, but actual is %+v", mine)
+	}
+	if shown := byName["shown"]; shown.Hide || shown.Cmd != `echo "secret"` {
+		t.Errorf("Expected hide: false to override the hide it extends, but actual is %+v", shown)
+	}
+}
+
+func TestResolveExtendsCycle(t *testing.T) {
+	cfg := Config{
+		Commands: map[string]Command{
+			"a": {Extends: "b"},
+			"b": {Extends: "a"},
+		},
+	}
+
+	if _, err := Resolve(cfg); err == nil {
+		t.Error("Expected Resolve to return an error for commands that extend each other.")
+	}
+}
+
+func TestLoadCommandList(t *testing.T) {
+	tests := map[string]string{
+		"testdata/list-commands/top.ahoy.yml":    "'commands' in testdata/list-commands/top.ahoy.yml is a list",
+		"testdata/list-commands/top.ahoy.json":   "'commands' in testdata/list-commands/top.ahoy.json is a list",
+		"testdata/list-commands/nested.ahoy.yml": "'commands.docker.commands' in testdata/list-commands/nested.ahoy.yml is a list",
+	}
+	for path, expected := range tests {
+		_, err := Load(path)
+		if err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("Expected Load(%s) to fail with %q, actual - %v", path, expected, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "commands:\n  build:\n") {
+			t.Errorf("Expected Load(%s) to show the map form, actual - %v", path, err)
+		}
+	}
+}
+
+func TestLoadFormats(t *testing.T) {
+	fromYaml, err := Load("testdata/format.ahoy.yml")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid YAML config:", err)
+	}
+
+	fromJSON, err := Load("testdata/format.ahoy.json")
+	if err != nil {
+		t.Fatal("Load returned an error for a valid JSON config:", err)
+	}
+
+	if fromJSON.File != "testdata/format.ahoy.json" {
+		t.Errorf("Expected cfg.File to be the loaded path, but actual is %s", fromJSON.File)
+	}
+	// Only the file they came from should differ.
+	fromJSON.File = fromYaml.File
+	if !reflect.DeepEqual(fromYaml, fromJSON) {
+		t.Errorf("Expected the YAML and JSON configs to match, but actual is\n%+v\n%+v", fromYaml, fromJSON)
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Offline stops remote imports from being downloaded, so that only
+// previously cached copies are used.
+var Offline bool
+
+// CacheDir is where remote imports are cached. When empty, an ahoy/imports
+// directory in the user's cache directory is used.
+var CacheDir string
+
+// CacheTTL is how long a cached remote import is used before it is
+// downloaded again.
+var CacheTTL = time.Hour
+
+// DownloadTimeout limits how long a download can take, so a slow host can't
+// hang every ahoy command.
+var DownloadTimeout = 10 * time.Second
+
+// isRemote reports whether an import refers to a URL rather than a file.
+func isRemote(include string) bool {
+	return strings.HasPrefix(include, "http://") || strings.HasPrefix(include, "https://")
+}
+
+// Download writes the contents of rawURL to w. Only http and https URLs are
+// allowed.
+func Download(w io.Writer, rawURL string) error {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return errors.New("Only http and https URLs can be downloaded, but '" + rawURL + "' was given.")
+	}
+
+	client := &http.Client{Timeout: DownloadTimeout}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Couldn't download " + rawURL + ": " + resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// DownloadFile downloads rawURL to path. Nothing is written if the download
+// fails.
+func DownloadFile(path string, rawURL string) error {
+	var buf bytes.Buffer
+	if err := Download(&buf, rawURL); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// fetchRemoteImport downloads a remote import into the cache and returns the
+// path of the cached copy. A copy cached less than CacheTTL ago is used
+// without downloading it again. If the download fails, or Offline is set, a
+// previously cached copy is used instead. It returns "" when Offline is set
+// and nothing has been cached yet, so the import is skipped.
+func fetchRemoteImport(rawURL string) (string, error) {
+	cacheDir := CacheDir
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		cacheDir = filepath.Join(userCacheDir, "ahoy", "imports")
+	}
+	cached := filepath.Join(cacheDir, fmt.Sprintf("%x.ahoy.yml", sha256.Sum256([]byte(rawURL))))
+	info, statErr := os.Stat(cached)
+	if statErr == nil && time.Since(info.ModTime()) < CacheTTL {
+		return cached, nil
+	}
+
+	if Offline {
+		if statErr != nil {
+			return "", nil
+		}
+		return cached, nil
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+	// Download to a temporary file so a failed download can't clobber the cache.
+	if err := DownloadFile(cached+".download", rawURL); err != nil {
+		os.Remove(cached + ".download")
+		if statErr == nil {
+			// Keep using the stale copy for another CacheTTL rather than
+			// waiting on the host for every command.
+			now := time.Now()
+			os.Chtimes(cached, now, now)
+			return cached, nil
+		}
+		return "", err
+	}
+	return cached, os.Rename(cached+".download", cached)
+}
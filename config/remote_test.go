@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResolveRemoteImports(t *testing.T) {
+	CacheDir = t.TempDir()
+	defer func() { CacheDir = "" }()
+
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		fmt.Fprint(w, "ahoyapi: v2\ncommands:\n  shared:\n    cmd: echo \"shared\"\n")
+	}))
+	cfg := Config{
+		Commands: map[string]Command{
+			"remote": {Imports: []Import{{File: server.URL + "/shared.ahoy.yml"}}},
+		},
+	}
+
+	commands, err := Resolve(cfg)
+	if err != nil {
+		t.Fatal("Resolve returned an error for a remote import:", err)
+	}
+	if len(commands[0].Subcommands) != 1 || commands[0].Subcommands[0].Name != "shared" {
+		t.Errorf("Expected the remote import's commands, but actual is %+v", commands[0].Subcommands)
+	}
+
+	// A fresh cached copy is used without downloading it again.
+	if _, err := Resolve(cfg); err != nil || downloads != 1 {
+		t.Errorf("Expected the cached copy to be used, actual - %d downloads, %v", downloads, err)
+	}
+
+	// Once it's older than CacheTTL, it's downloaded again.
+	CacheTTL = 0
+	defer func() { CacheTTL = time.Hour }()
+	if _, err := Resolve(cfg); err != nil || downloads != 2 {
+		t.Errorf("Expected a stale copy to be downloaded again, actual - %d downloads, %v", downloads, err)
+	}
+
+	// Offline, the cached copy is used without contacting the server.
+	server.Close()
+	Offline = true
+	defer func() { Offline = false }()
+	commands, err = Resolve(cfg)
+	if err != nil || len(commands[0].Subcommands) != 1 {
+		t.Errorf("Expected the cached copy to be used offline, but actual is %+v, %v", commands, err)
+	}
+
+	// Offline with nothing cached, the import is skipped.
+	CacheDir = t.TempDir()
+	if _, err := Resolve(cfg); err == nil {
+		t.Error("Expected an error as the only import was skipped, leaving no commands.")
+	}
+}
+
+func TestDownloadTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { DownloadTimeout = timeout }(DownloadTimeout)
+	DownloadTimeout = 50 * time.Millisecond
+
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	if err := DownloadFile(t.TempDir()+"/file", server.URL); err == nil {
+		t.Error("Expected DownloadFile to give up on a host that doesn't respond.")
+	}
+}
+
+func TestDownloadFileSchemes(t *testing.T) {
+	if err := DownloadFile(t.TempDir()+"/file", "file:///etc/passwd"); err == nil {
+		t.Error("Expected DownloadFile to refuse a file:// URL.")
+	}
+}
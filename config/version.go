@@ -0,0 +1,83 @@
+package config
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// AhoyVersion is the version of the running ahoy, which files' min_ahoy is
+// checked against. Nothing is checked when it isn't a version, like for
+// development builds.
+var AhoyVersion string
+
+// parseVersion splits a version like "v2.4.0", or "2.4.0-3-gabc123" from git
+// describe, into its numbers.
+func parseVersion(version string) ([]int, error) {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	var parts []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, errors.New("'" + version + "' isn't a version like v2.4.0")
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+// CompareVersions returns -1, 0 or 1 when version a is older than, the same
+// as, or newer than version b. Missing parts count as 0, so v2.4 is v2.4.0.
+func CompareVersions(a string, b string) (int, error) {
+	aParts, err := parseVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	bParts, err := parseVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	for len(aParts) < len(bParts) {
+		aParts = append(aParts, 0)
+	}
+	for len(bParts) < len(aParts) {
+		bParts = append(bParts, 0)
+	}
+	for i := range aParts {
+		if aParts[i] < bParts[i] {
+			return -1, nil
+		}
+		if aParts[i] > bParts[i] {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// CheckMinAhoy returns an error asking for ahoy to be upgraded if cfg's
+// min_ahoy, or min_ahoy_version, is newer than AhoyVersion.
+func CheckMinAhoy(cfg Config) error {
+	return checkMinAhoy(cfg, "The ahoy file ["+cfg.File+"]")
+}
+
+// checkMinAhoy returns an error if cfg needs a newer ahoy than AhoyVersion,
+// with what describing the file in it.
+func checkMinAhoy(cfg Config, what string) error {
+	if cfg.MinAhoy == "" {
+		return nil
+	}
+	if _, err := parseVersion(AhoyVersion); err != nil {
+		return nil
+	}
+	compared, err := CompareVersions(AhoyVersion, cfg.MinAhoy)
+	if err != nil {
+		return errors.New(what + " has an invalid min_ahoy: " + err.Error())
+	}
+	if compared < 0 {
+		return errors.New(what + " needs ahoy " + cfg.MinAhoy + " or newer, but this is ahoy " + AhoyVersion + ". Please upgrade ahoy.")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package config
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"v2.4.0", "v2.4.0", 0},
+		{"2.4", "v2.4.0", 0},
+		{"v2.3.9", "v2.4.0", -1},
+		{"v2.10.0", "v2.4.0", 1},
+		{"2.4.1-3-gabc123", "v2.4.0", 1},
+	}
+	for _, c := range cases {
+		actual, err := CompareVersions(c.a, c.b)
+		if err != nil || actual != c.expected {
+			t.Errorf("CompareVersions(%s, %s): expected %d, but actual is %d, %v", c.a, c.b, c.expected, actual, err)
+		}
+	}
+
+	if _, err := CompareVersions("latest", "v2.4.0"); err == nil {
+		t.Error("Expected an error comparing something that isn't a version.")
+	}
+}
+
+func TestResolveImportsMinAhoy(t *testing.T) {
+	defer func() { AhoyVersion = "" }()
+	imports := []string{"versions/min-ahoy.ahoy.yml"}
+
+	AhoyVersion = "v2.1.0"
+	if _, err := ResolveImports("testdata", imports); err == nil {
+		t.Error("Expected an error for an import needing a newer ahoy.")
+	}
+
+	AhoyVersion = "v2.4.0"
+	if commands, err := ResolveImports("testdata", imports); err != nil || len(commands) != 1 {
+		t.Errorf("Expected the import to load with a new enough ahoy, but actual is %+v, %v", commands, err)
+	}
+
+	// Development builds don't have a version to check.
+	AhoyVersion = ""
+	if _, err := ResolveImports("testdata", imports); err != nil {
+		t.Errorf("Expected the import to load without a version, but actual is %v", err)
+	}
+}
+
+func TestCheckMinAhoy(t *testing.T) {
+	defer func() { AhoyVersion = "" }()
+	cfg, err := Parse([]byte("ahoyapi: v2\nmin_ahoy_version: v2.5.0\n"), "project/.ahoy.yml")
+	if err != nil {
+		t.Fatal("Parse returned an error for a valid config:", err)
+	}
+
+	AhoyVersion = "v2.4.0"
+	expected := "The ahoy file [project/.ahoy.yml] needs ahoy v2.5.0 or newer, but this is ahoy v2.4.0. Please upgrade ahoy."
+	if err := CheckMinAhoy(cfg); err == nil || err.Error() != expected {
+		t.Errorf("Expected %q, but actual is %v", expected, err)
+	}
+
+	AhoyVersion = "v2.5.0"
+	if err := CheckMinAhoy(cfg); err != nil {
+		t.Errorf("Expected no error with a new enough ahoy, but actual is %v", err)
+	}
+
+	// Development builds don't have a version to check.
+	AhoyVersion = "dev"
+	if err := CheckMinAhoy(cfg); err != nil {
+		t.Errorf("Expected no error without a version, but actual is %v", err)
+	}
+}
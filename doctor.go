@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ahoy-cli/ahoy/config"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+)
+
+// runDoctor checks the environment ahoy needs and prints what it finds. It
+// returns false if a check failed that would stop commands from running.
+func runDoctor() bool {
+	ok := true
+	ahoyVersion := version
+	if ahoyVersion == "" {
+		ahoyVersion = "unknown"
+	}
+	fmt.Fprintln(stdout, "ahoy version: "+ahoyVersion)
+	fmt.Fprintln(stdout, "go runtime: "+runtime.Version()+" "+runtime.GOOS+"/"+runtime.GOARCH)
+
+	if AhoyConf.srcFile == "" {
+		fmt.Fprintln(stdout, "[warn] config: no .ahoy.yml found")
+	} else if AhoyConf.srcFile == "-" {
+		fmt.Fprintln(stdout, "[ok] config: read from stdin")
+	} else {
+		path, _ := filepath.Abs(AhoyConf.srcFile)
+		fmt.Fprintln(stdout, "[ok] config: "+path)
+	}
+
+	for _, shell := range getShells(AhoyConf.commands) {
+		if path, err := exec.LookPath(shell); err == nil {
+			fmt.Fprintln(stdout, "[ok] shell: "+shell+" ("+path+")")
+		} else {
+			fmt.Fprintln(stdout, "[fail] shell: "+shell+" wasn't found on your PATH")
+			ok = false
+		}
+	}
+
+	// 'ahoy init' writes to the current directory.
+	if f, err := ioutil.TempFile(".", ".ahoy-doctor"); err == nil {
+		f.Close()
+		os.Remove(f.Name())
+		fmt.Fprintln(stdout, "[ok] current directory is writable")
+	} else {
+		fmt.Fprintln(stdout, "[warn] current directory isn't writable, so 'ahoy init' won't work here")
+	}
+	return ok
+}
+
+// getShells returns the programs that commands are run with, from their
+// entrypoints. Without any commands it returns the default entrypoint's.
+func getShells(commands []config.ResolvedCommand) []string {
+	found := map[string]bool{}
+	var walk func([]config.ResolvedCommand)
+	walk = func(commands []config.ResolvedCommand) {
+		for _, cmd := range commands {
+			if cmd.Cmd != "" && len(cmd.Entrypoint) > 0 {
+				found[cmd.Entrypoint[0]] = true
+			}
+			walk(cmd.Subcommands)
+		}
+	}
+	walk(commands)
+	if len(found) == 0 {
+		found[config.DefaultEntrypoint[0]] = true
+	}
+
+	var shells []string
+	for shell := range found {
+		shells = append(shells, shell)
+	}
+	sort.Strings(shells)
+	return shells
+}
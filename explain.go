@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// explanation is what --explain shows about how a command will run.
+type explanation struct {
+	Command     string   `json:"command"`
+	File        string   `json:"file"`
+	Cmd         string   `json:"cmd,omitempty"`
+	Parallel    []string `json:"parallel,omitempty"`
+	Steps       []string `json:"steps,omitempty"`
+	Shell       string   `json:"shell,omitempty"`
+	Dir         string   `json:"dir"`
+	CommandLine []string `json:"command_line,omitempty"`
+}
+
+// explainCommand prints how the command named at the start of args would be
+// run, with the rest of args as sample arguments. It returns false if there
+// is no such command.
+func explainCommand(args []string) bool {
+	name, found := matchCommand(args)
+	if !found {
+		return false
+	}
+	cmd, _ := findCommand(name)
+	sampleArgs := args[len(strings.Fields(name)):]
+
+	e := explanation{
+		Command:  name,
+		File:     cmd.File,
+		Parallel: cmd.Parallel,
+		Steps:    cmd.Steps,
+		Dir:      AhoyConf.srcDir,
+	}
+	if e.File != "-" {
+		e.File, _ = filepath.Abs(e.File)
+	}
+	e.Dir, _ = filepath.Abs(e.Dir)
+	if cmd.Cmd != "" {
+		e.Cmd = cmd.Cmd
+		e.Shell = cmd.Entrypoint[0]
+		// Values are masked before they're quoted or encoded, which would
+		// change how they're written.
+		for _, arg := range getExecCommand(cmd, cmd.Name, sampleArgs).Args {
+			e.CommandLine = append(e.CommandLine, maskSecrets(arg))
+		}
+	}
+
+	if outputJSON {
+		out, _ := json.MarshalIndent(e, "", "  ")
+		fmt.Fprintln(stdout, string(out))
+		return true
+	}
+	fmt.Fprintln(stdout, "command: "+e.Command)
+	fmt.Fprintln(stdout, "file: "+e.File)
+	if e.Cmd != "" {
+		fmt.Fprintln(stdout, "cmd: "+e.Cmd)
+		fmt.Fprintln(stdout, "shell: "+e.Shell)
+	}
+	if len(e.Parallel) > 0 {
+		fmt.Fprintln(stdout, "parallel: "+strings.Join(e.Parallel, ", "))
+	}
+	if len(e.Steps) > 0 {
+		fmt.Fprintln(stdout, "steps: "+strings.Join(e.Steps, ", "))
+	}
+	fmt.Fprintln(stdout, "dir: "+e.Dir)
+	if len(e.CommandLine) > 0 {
+		fmt.Fprintln(stdout, "command line: "+shellQuote(e.CommandLine))
+	}
+	return true
+}
+
+// matchCommand returns the name of the command at the start of args. The
+// longest run of args naming a command is the command, so that subcommands
+// like "docker build" are found.
+func matchCommand(args []string) (string, bool) {
+	var name string
+	var found bool
+	for i := range args {
+		if _, ok := findCommand(strings.Join(args[:i+1], " ")); !ok {
+			break
+		}
+		name, found = strings.Join(args[:i+1], " "), true
+	}
+	return name, found
+}
+
+// dumpEnv prints the environment that the command named at the start of args
+// would be run with, as sorted KEY=VALUE lines. It returns false if there is
+// no such command.
+func dumpEnv(args []string) bool {
+	name, found := matchCommand(args)
+	if !found {
+		return false
+	}
+	cmd, _ := findCommand(name)
+	env := getExecCommand(cmd, cmd.Name, nil).Env
+	if env == nil {
+		env = os.Environ()
+	}
+
+	// Later values win, like they do for the command.
+	values := map[string]string{}
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			values[kv[:i]] = kv[i+1:]
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if isMasked(key) {
+			fmt.Fprintln(stdout, key+"=***")
+			continue
+		}
+		fmt.Fprintln(stdout, key+"="+maskSecrets(values[key]))
+	}
+	return true
+}
+
+// shellQuote joins args into a line that could be pasted into a shell.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+			return !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:@%+,", r)
+		}) == -1 {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
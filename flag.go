@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"github.com/ahoy-cli/ahoy/config"
 	"github.com/codegangsta/cli"
 )
 
@@ -13,9 +14,150 @@ var globalFlags = []cli.Flag{
 		Destination: &verbose,
 	},
 	cli.StringFlag{
-		Name:        "file, f",
-		Usage:       "Use a specific ahoy file.",
-		Destination: &sourcefile,
+		Name:        "log-level",
+		Value:       "info",
+		Usage:       "Only log messages at or above this level: debug, info, warn or error.",
+		EnvVar:      "AHOY_LOG_LEVEL",
+		Destination: &logLevel,
+	},
+	cli.StringFlag{
+		Name:        "log-format",
+		Value:       "text",
+		Usage:       "Format of log messages: text, or json for one object per line.",
+		EnvVar:      "AHOY_LOG_FORMAT",
+		Destination: &logFormat,
+	},
+	cli.StringSliceFlag{
+		Name:  "file, f",
+		Usage: "Use a specific ahoy file, or the .ahoy.yml in a directory. Repeat to merge files, with later files winning.",
+		Value: &sourcefiles,
+	},
+	cli.StringSliceFlag{
+		Name:  "env, e",
+		Usage: "Set an environment variable for commands, as KEY=VALUE. Repeat to set more.",
+		Value: &envOverrides,
+	},
+	cli.StringSliceFlag{
+		Name:  "commands-from",
+		Usage: "Merge in the commands from another ahoy file, overriding commands with the same name. Repeat to add more.",
+		Value: &commandsFrom,
+	},
+	cli.StringFlag{
+		Name:        "cwd",
+		Usage:       "Run as if ahoy was started in this directory.",
+		Destination: &workingDir,
+	},
+	cli.StringFlag{
+		Name:        "import-base",
+		Usage:       "Resolve relative imports against this directory instead of the ahoy file's directory.",
+		EnvVar:      "AHOY_IMPORT_BASE",
+		Destination: &importBase,
+	},
+	cli.BoolFlag{
+		Name:        "offline",
+		Usage:       "Don't download remote imports, only use previously cached copies.",
+		EnvVar:      "AHOY_OFFLINE",
+		Destination: &config.Offline,
+	},
+	cli.BoolFlag{
+		Name:        "no-global",
+		Usage:       "Don't merge in commands from the global ~/.ahoy.yml file.",
+		EnvVar:      "AHOY_NO_GLOBAL",
+		Destination: &noGlobal,
+	},
+	cli.BoolFlag{
+		Name:        "no-local",
+		Usage:       "Don't merge in commands from a .ahoy.local.yml next to the ahoy file.",
+		EnvVar:      "AHOY_NO_LOCAL",
+		Destination: &noLocal,
+	},
+	cli.BoolFlag{
+		Name:        "no-default-commands",
+		Usage:       "Don't add built-in commands like init.",
+		EnvVar:      "AHOY_NO_DEFAULT_COMMANDS",
+		Destination: &noDefaultCommands,
+	},
+	cli.BoolFlag{
+		Name:        "trace",
+		Usage:       "Have bash and sh print each line of a command as it runs, with -x.",
+		EnvVar:      "AHOY_TRACE",
+		Destination: &trace,
+	},
+	cli.BoolFlag{
+		Name:        "errexit",
+		Usage:       "Make bash and sh commands exit on the first failure, unset variable or failed pipeline stage.",
+		EnvVar:      "AHOY_ERREXIT",
+		Destination: &errexit,
+	},
+	cli.BoolFlag{
+		Name:        "force",
+		Usage:       "Run commands even when their outputs are newer than their inputs.",
+		EnvVar:      "AHOY_FORCE",
+		Destination: &force,
+	},
+	cli.BoolFlag{
+		Name:        "batch",
+		Usage:       "Treat each argument as a command to run, one after another, stopping at the first failure.",
+		Destination: &batch,
+	},
+	cli.BoolFlag{
+		Name:        "keep-going",
+		Usage:       "Like --batch, but run every command even after one fails.",
+		Destination: &keepGoing,
+	},
+	cli.BoolFlag{
+		Name:        "watch",
+		Usage:       "Run a command again each time the files in its 'watch' globs change, until interrupted.",
+		Destination: &watch,
+	},
+	cli.BoolFlag{
+		Name:        "yes, y",
+		Usage:       "Answer yes to the confirm prompt of commands, for running them without a terminal.",
+		EnvVar:      "AHOY_YES",
+		Destination: &assumeYes,
+	},
+	cli.BoolFlag{
+		Name:        "prefix",
+		Usage:       "Prefix each line of a command's output with its name, like [build].",
+		EnvVar:      "AHOY_PREFIX",
+		Destination: &prefixOutput,
+	},
+	cli.BoolFlag{
+		Name:        "time",
+		Usage:       "Print how long each command took to stderr.",
+		EnvVar:      "AHOY_TIME",
+		Destination: &timeCommands,
+	},
+	cli.BoolFlag{
+		Name:        "explain",
+		Usage:       "Show where a command comes from and how it would be run with the given arguments, without running it.",
+		Destination: &explain,
+	},
+	cli.BoolFlag{
+		Name:        "dump-env",
+		Usage:       "Print the environment a command would be run with, as sorted KEY=VALUE lines, without running it.",
+		Destination: &dumpEnvironment,
+	},
+	cli.BoolFlag{
+		Name:        "json",
+		Usage:       "Print the output of --explain as JSON.",
+		Destination: &outputJSON,
+	},
+	cli.BoolFlag{
+		Name:        "skip-setup",
+		Usage:       "Don't run the ahoy file's setup command, even if it hasn't run here yet.",
+		EnvVar:      "AHOY_SKIP_SETUP",
+		Destination: &skipSetup,
+	},
+	cli.BoolFlag{
+		Name:        "list-hidden",
+		Usage:       "Include hidden commands in help and docs, marked as hidden.",
+		Destination: &listHidden,
+	},
+	cli.BoolFlag{
+		Name:        "print-config-path",
+		Usage:       "Print the path of the ahoy file that would be used, then exit.",
+		Destination: &printConfigPath,
 	},
 	cli.BoolFlag{
 		Name:  "help, h",
@@ -44,15 +186,39 @@ func initFlags(incomingFlags []string) {
 	// Reset the sourcedir for when we're testing. Otherwise the global state
 	// is preserved between the tests.
 	AhoyConf.srcDir = ""
+	AhoyConf.commands = nil
+	AhoyConf.defaultCommand = ""
+	AhoyConf.setupCommand = ""
+	AhoyConf.auditLog = ""
+	AhoyConf.maskEnv = nil
+	ranDependencies = map[string]bool{}
 
 	// Grab the global flags first ourselves so we can customize the yaml file loaded.
 	// Flags are only parsed once, so we need to do this before cli has the chance to?
+	sourcefiles = cli.StringSlice{}
+	envOverrides = cli.StringSlice{}
+	commandsFrom = cli.StringSlice{}
 	tempFlags := flagSet("tempFlags", globalFlags)
 	tempFlags.Parse(incomingFlags)
+
+	// The first file is the main ahoy file, which commands are run from.
+	sourcefile = ""
+	if len(sourcefiles) > 0 {
+		sourcefile = sourcefiles[0]
+	}
 }
 
 func overrideFlags(app *cli.App) {
-	app.Flags = globalFlags
+	// The app parses the flags again, and StringSlice appends, so it gets
+	// its own slices rather than adding to the ones initFlags filled in.
+	app.Flags = make([]cli.Flag, len(globalFlags))
+	for i, f := range globalFlags {
+		if sliceFlag, ok := f.(cli.StringSliceFlag); ok {
+			sliceFlag.Value = &cli.StringSlice{}
+			f = sliceFlag
+		}
+		app.Flags[i] = f
+	}
 	app.HideVersion = true
 	app.HideHelp = true
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ahoy-cli/ahoy/config"
+)
+
+// isUpToDate reports whether every file matching cmd.Outputs is newer than
+// every file matching cmd.Inputs, so the command doesn't need to run again.
+// Patterns are relative to the ahoy file's directory, and "**" matches any
+// number of directories.
+func isUpToDate(cmd config.ResolvedCommand) (bool, error) {
+	if len(cmd.Inputs) == 0 || len(cmd.Outputs) == 0 {
+		return false, nil
+	}
+
+	var oldestOutput time.Time
+	for _, pattern := range cmd.Outputs {
+		files, err := globFiles(AhoyConf.srcDir, pattern)
+		if err != nil {
+			return false, err
+		}
+		// A missing output always means the command has to run.
+		if len(files) == 0 {
+			return false, nil
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				return false, err
+			}
+			if oldestOutput.IsZero() || info.ModTime().Before(oldestOutput) {
+				oldestOutput = info.ModTime()
+			}
+		}
+	}
+
+	for _, pattern := range cmd.Inputs {
+		files, err := globFiles(AhoyConf.srcDir, pattern)
+		if err != nil {
+			return false, err
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				return false, err
+			}
+			if !info.ModTime().Before(oldestOutput) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// globFiles returns the files under dir that match pattern. It works like
+// filepath.Glob, except that a "**" path segment matches zero or more
+// directories.
+func globFiles(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return onlyFiles(matches), nil
+	}
+
+	// Walk from the deepest directory before the first "**", matching each
+	// file's path against the pattern segment by segment.
+	root := filepath.Dir(pattern[:strings.Index(pattern, "**")+1])
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	var matches []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		ok, err := matchSegments(segments, strings.Split(filepath.ToSlash(path), "/"))
+		if ok {
+			matches = append(matches, path)
+		}
+		return err
+	})
+	return matches, err
+}
+
+// matchSegments matches path segments against pattern segments, where a
+// "**" pattern segment matches any number of path segments.
+func matchSegments(pattern, path []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(path) == 0, nil
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if ok, err := matchSegments(pattern[1:], path[i:]); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	if len(path) == 0 {
+		return false, nil
+	}
+	ok, err := filepath.Match(pattern[0], path[0])
+	if !ok || err != nil {
+		return false, err
+	}
+	return matchSegments(pattern[1:], path[1:])
+}
+
+// onlyFiles drops any directories from paths.
+func onlyFiles(paths []string) []string {
+	var files []string
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+	}
+	return files
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/ahoy-cli/ahoy/config"
+)
+
+// writeMarkdownDocs writes a markdown section for each command that isn't
+// hidden, or every command with --list-hidden, with its usage, description
+// and arguments, followed by the sections for its subcommands.
+func writeMarkdownDocs(w io.Writer, commands []config.ResolvedCommand) {
+	fmt.Fprintln(w, "# Commands")
+	writeMarkdownCommands(w, commands, "ahoy")
+}
+
+func writeMarkdownCommands(w io.Writer, commands []config.ResolvedCommand, parent string) {
+	sorted := append([]config.ResolvedCommand{}, commands...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	for _, cmd := range sorted {
+		if cmd.IsHidden() && !listHidden {
+			continue
+		}
+		name := parent + " " + cmd.Name
+		fmt.Fprintf(w, "\n## `%s`\n", name)
+		if cmd.IsHidden() {
+			fmt.Fprintln(w, "\n*Hidden*")
+		}
+		if cmd.Usage != "" {
+			fmt.Fprintf(w, "\n%s\n", cmd.Usage)
+		}
+		if cmd.Description != "" {
+			fmt.Fprintf(w, "\n%s\n", strings.TrimSpace(cmd.Description))
+		}
+		if len(cmd.Arguments) > 0 {
+			fmt.Fprintf(w, "\n```\n%s %s\n```\n", name, getArgsUsage(cmd.Arguments))
+			fmt.Fprintln(w, "\n| Argument | Required | Description |")
+			fmt.Fprintln(w, "| --- | --- | --- |")
+			for _, arg := range cmd.Arguments {
+				required := "no"
+				if arg.Required {
+					required = "yes"
+				}
+				fmt.Fprintf(w, "| `%s` | %s | %s |\n", arg.Name, required, strings.Replace(arg.Description, "|", "\\|", -1))
+			}
+		}
+		if len(cmd.Examples) > 0 {
+			fmt.Fprintln(w, "\nExamples:\n\n```")
+			for _, example := range cmd.Examples {
+				fmt.Fprintln(w, example)
+			}
+			fmt.Fprintln(w, "```")
+		}
+		writeMarkdownCommands(w, cmd.Subcommands, name)
+	}
+}
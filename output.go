@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// stdout is where ahoy's own output goes, like help and --explain. When the
+// reader has gone away, like 'ahoy docs | head' once head has its lines, ahoy
+// exits quietly with 0 like other unix tools.
+var stdout = stdoutWriter{}
+
+// stdoutClosed is set once a write to stdout has failed because its reader
+// has gone away.
+var stdoutClosed bool
+
+type stdoutWriter struct{}
+
+func (stdoutWriter) Write(p []byte) (int, error) {
+	n, err := os.Stdout.Write(p)
+	if errors.Is(err, syscall.EPIPE) {
+		stdoutClosed = true
+		exit(0)
+	}
+	return n, err
+}
+
+// isMasked reports whether the environment variable key is named by the
+// ahoy file's mask_env.
+func isMasked(key string) bool {
+	for _, re := range AhoyConf.maskEnv {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// minMaskedLength is the shortest value that maskSecrets replaces. Shorter
+// values, like "1" or "true", would mask unrelated parts of the output, and
+// aren't secrets anyway.
+const minMaskedLength = 4
+
+// maskSecrets replaces the values of masked environment variables in text
+// with ***, including values given with --env.
+func maskSecrets(text string) string {
+	if len(AhoyConf.maskEnv) == 0 {
+		return text
+	}
+	for _, kv := range append(os.Environ(), envOverrides...) {
+		i := strings.Index(kv, "=")
+		if i <= 0 || len(kv)-i-1 < minMaskedLength || !isMasked(kv[:i]) {
+			continue
+		}
+		text = strings.Replace(text, kv[i+1:], "***", -1)
+	}
+	return text
+}
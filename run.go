@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ahoy-cli/ahoy/config"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// runningSteps holds the names of the step commands being run, so that a
+// command can't end up running itself.
+var runningSteps []string
+
+// dependencyChain holds the commands whose dependencies are being run, so
+// that dependency cycles can be reported.
+var dependencyChain []string
+
+// ranDependencies records the dependencies that have already run, so each
+// one only runs once per invocation.
+var ranDependencies = map[string]bool{}
+
+// runDependencies runs the commands named in cmd.Depends, and their own
+// dependencies first, stopping at the first one that fails.
+func runDependencies(cmd config.ResolvedCommand) error {
+	for _, name := range dependencyChain {
+		if name == cmd.Name {
+			err := errors.New("Command [" + cmd.Name + "] depends on itself: " + strings.Join(append(dependencyChain, cmd.Name), " -> "))
+			logger("error", err.Error())
+			return err
+		}
+	}
+	dependencyChain = append(dependencyChain, cmd.Name)
+	defer func() { dependencyChain = dependencyChain[:len(dependencyChain)-1] }()
+
+	for _, name := range cmd.Depends {
+		if ranDependencies[name] {
+			continue
+		}
+		dependency, ok := findCommand(name)
+		if !ok {
+			err := errors.New("Command [" + cmd.Name + "] depends on [" + name + "], but it doesn't exist.")
+			logger("error", err.Error())
+			return err
+		}
+		if err := runCommand(dependency, dependency.Name, nil); err != nil {
+			return err
+		}
+		ranDependencies[name] = true
+	}
+	return nil
+}
+
+// runParallel runs the commands named in cmd.Parallel at the same time, with
+// each line of their output prefixed by the command's name. Their depends
+// run first, one at a time. It waits for all of them to finish, and fails if
+// any of them failed.
+func runParallel(cmd config.ResolvedCommand) error {
+	var commands []config.ResolvedCommand
+	for _, name := range cmd.Parallel {
+		parallelCmd, ok := findCommand(name)
+		if !ok || parallelCmd.Cmd == "" {
+			err := errors.New("Command [" + cmd.Name + "] runs [" + name + "] in parallel, but it isn't a command with 'cmd' set.")
+			logger("error", err.Error())
+			return err
+		}
+		// Commands running side by side can't share the terminal.
+		if parallelCmd.Confirm != "" || parallelCmd.Interactive {
+			err := errors.New("Command [" + cmd.Name + "] runs [" + name + "] in parallel, but it uses 'confirm' or 'interactive', which need the terminal to itself.")
+			logger("error", err.Error())
+			return err
+		}
+		commands = append(commands, parallelCmd)
+	}
+
+	for i, parallelCmd := range commands {
+		if len(parallelCmd.Depends) == 0 {
+			continue
+		}
+		if err := runDependencies(parallelCmd); err != nil {
+			return err
+		}
+		commands[i].Depends = nil
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	var interrupted error
+	for _, parallelCmd := range commands {
+		wg.Add(1)
+		go func(parallelCmd config.ResolvedCommand) {
+			defer wg.Done()
+			cio := commandIO{stdout: os.Stdout, stderr: os.Stderr, prefix: true, mu: &mu}
+			err := runCommandIO(parallelCmd, parallelCmd.Name, nil, cio)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed++
+			}
+			if errors.Is(err, errInterrupted) {
+				interrupted = err
+			}
+		}(parallelCmd)
+	}
+	wg.Wait()
+
+	if interrupted != nil {
+		return interrupted
+	}
+	if failed > 0 {
+		err := errors.New("Command [" + cmd.Name + "] failed because some of the commands it runs in parallel failed.")
+		logger("error", err.Error())
+		return err
+	}
+	return nil
+}
+
+// runSteps runs the commands named in cmd.Steps one after another. It stops
+// at the first step that fails and returns its error, unless
+// cmd.ContinueOnError is set, in which case every step runs and the first
+// failure is returned at the end.
+func runSteps(cmd config.ResolvedCommand) error {
+	for _, name := range runningSteps {
+		if name == cmd.Name {
+			err := errors.New("Command [" + cmd.Name + "] runs itself through its steps: " + strings.Join(append(runningSteps, cmd.Name), " -> "))
+			logger("error", err.Error())
+			return err
+		}
+	}
+	runningSteps = append(runningSteps, cmd.Name)
+	defer func() { runningSteps = runningSteps[:len(runningSteps)-1] }()
+	defer restoreEnv(os.Environ())
+
+	var firstErr error
+	for i, name := range cmd.Steps {
+		stepCmd, ok := findCommand(name)
+		if !ok || (stepCmd.Cmd == "" && stepCmd.Parallel == nil && stepCmd.Steps == nil) {
+			err := errors.New("Command [" + cmd.Name + "] has [" + name + "] as a step, but it isn't a command that can be run.")
+			logger("error", err.Error())
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "==> step %d: %s\n", i+1, name)
+		var err error
+		if stepCmd.Capture != "" && stepCmd.Cmd != "" {
+			err = runCaptured(stepCmd)
+		} else {
+			err = runCommand(stepCmd, stepCmd.Name, nil)
+		}
+		if err != nil {
+			if !cmd.ContinueOnError || errors.Is(err, errInterrupted) {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// runBatch runs each of the named commands in turn, without arguments, for
+// --batch. It stops at the first one that fails unless keepGoing is set, and
+// returns the exit code of the first failure, or 0.
+func runBatch(names []string, keepGoing bool) int {
+	var commands []config.ResolvedCommand
+	for _, name := range names {
+		cmd, ok := findCommand(name)
+		if !ok {
+			logger("error", "Command not found for '"+name+"'")
+			return 1
+		}
+		commands = append(commands, cmd)
+	}
+
+	if err := runSetup(commands[0].Name); err != nil {
+		return getExitCode(err)
+	}
+	code := 0
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "==> %s\n", cmd.Name)
+		err := runCommand(cmd, cmd.Name, nil)
+		if err == nil && cmd.Name == AhoyConf.setupCommand {
+			markSetupDone()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "==> %s failed with exit code %d\n", cmd.Name, getExitCode(err))
+			if code == 0 {
+				code = getExitCode(err)
+			}
+			if !keepGoing || errors.Is(err, errInterrupted) {
+				return code
+			}
+		}
+	}
+	return code
+}
+
+// runCaptured runs a step with Capture set, putting its trimmed stdout in the
+// environment variable named by Capture for the steps after it.
+func runCaptured(cmd config.ResolvedCommand) error {
+	var out bytes.Buffer
+	cio := commandIO{stdin: os.Stdin, stdout: &out, stderr: os.Stderr}
+	if err := runCommandIO(cmd, cmd.Name, nil, cio); err != nil {
+		return err
+	}
+	return os.Setenv(cmd.Capture, strings.TrimSpace(out.String()))
+}
+
+// restoreEnv puts the environment back to env, so values captured by steps
+// don't outlive their group.
+func restoreEnv(env []string) {
+	os.Clearenv()
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			os.Setenv(kv[:i], kv[i+1:])
+		}
+	}
+}
+
+// prefixWriter writes each complete line to w with a prefix. Writers that
+// share a mutex never interleave their lines.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix string, mu *sync.Mutex) *prefixWriter {
+	return &prefixWriter{w: w, prefix: prefix, mu: mu}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return len(b), err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes any output left over that didn't end with a newline.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.writeLine(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(append([]byte(p.prefix), line...))
+	return err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// setupMarker is the file, next to the ahoy file, that records the setup
+// command has run there.
+const setupMarker = ".ahoy.setup-done"
+
+// getSetupMarkerPath returns the marker file for the current ahoy file.
+func getSetupMarkerPath() string {
+	return filepath.Join(AhoyConf.srcDir, setupMarker)
+}
+
+// runSetup runs the ahoy file's setup command the first time any other
+// command is run from it, then writes the marker file so it isn't run again.
+// Nothing happens with --skip-setup, or when name is the setup command.
+func runSetup(name string) error {
+	if AhoyConf.setupCommand == "" || skipSetup || name == AhoyConf.setupCommand {
+		return nil
+	}
+	if _, err := os.Stat(getSetupMarkerPath()); err == nil {
+		return nil
+	}
+	cmd, ok := findCommand(AhoyConf.setupCommand)
+	if !ok {
+		logger("warn", "The setup command '"+AhoyConf.setupCommand+"' doesn't exist.")
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "==> %s (first run setup)\n", cmd.Name)
+	// Commands that call ahoy themselves shouldn't start the setup again.
+	os.Setenv("AHOY_SKIP_SETUP", "1")
+	defer os.Unsetenv("AHOY_SKIP_SETUP")
+	if err := runCommand(cmd, cmd.Name, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "==> %s failed with exit code %d. Fix it and try again, or use --skip-setup.\n", cmd.Name, getExitCode(err))
+		return err
+	}
+	markSetupDone()
+	return nil
+}
+
+// markSetupDone writes the marker file. Failing to write it only logs a
+// warning, since the setup itself worked.
+func markSetupDone() {
+	content := []byte(time.Now().Format(time.RFC3339) + "\n")
+	if err := ioutil.WriteFile(getSetupMarkerPath(), content, 0644); err != nil {
+		logger("warn", "Couldn't write "+getSetupMarkerPath()+": "+err.Error())
+	}
+}
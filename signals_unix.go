@@ -0,0 +1,95 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// interactiveSignals are forwarded to interactive commands. SIGTSTP isn't
+// caught, so Ctrl-Z stops ahoy along with the command and the shell gets the
+// terminal back.
+var interactiveSignals = []os.Signal{os.Interrupt}
+
+// shutdownSignals stop ahoy and the command it is running.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// shutdownGrace is how long a command gets to exit after being signalled
+// before its process group is killed.
+var shutdownGrace = 5 * time.Second
+
+// runWithShutdown runs command, passing SIGINT and SIGTERM on to it and
+// returning errInterrupted once it has exited.
+//
+// Without a controlling terminal, the command runs in its own process group
+// and signals go to the whole group, so grandchildren are stopped too. With
+// one the command stays in ahoy's foreground group, even when stdin is piped:
+// the terminal already sends Ctrl-C to all of it, and a background group
+// couldn't read from /dev/tty.
+func runWithShutdown(command *exec.Cmd) error {
+	ownGroup := !hasControllingTerminal()
+	if ownGroup {
+		command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	defer signal.Stop(signals)
+
+	if err := command.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- command.Wait() }()
+
+	select {
+	case err := <-exited:
+		return err
+	case sig := <-signals:
+		target := command.Process.Pid
+		if ownGroup {
+			target = -target
+		}
+		// Ctrl-C from a terminal has already reached a command sharing our
+		// process group, so only pass on signals it hasn't seen.
+		if ownGroup || sig != os.Interrupt {
+			syscall.Kill(target, sig.(syscall.Signal))
+		}
+		select {
+		case <-exited:
+		case <-time.After(shutdownGrace):
+			syscall.Kill(target, syscall.SIGKILL)
+			<-exited
+		}
+		return errInterrupted
+	}
+}
+
+// hasControllingTerminal reports whether ahoy has a terminal that commands
+// could read from through /dev/tty.
+func hasControllingTerminal() bool {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
+}
+
+// catchBrokenPipe has writes to a closed stdout fail with EPIPE, for stdout to
+// handle, instead of the Go runtime killing ahoy with SIGPIPE. It only sets
+// this up once, however many times Run is called.
+func catchBrokenPipe() {
+	brokenPipeOnce.Do(func() {
+		signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+	})
+}
+
+var brokenPipeOnce sync.Once
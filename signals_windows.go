@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// interactiveSignals are forwarded to interactive commands when they don't
+// come from the terminal.
+var interactiveSignals = []os.Signal{os.Interrupt}
+
+// shutdownSignals stop ahoy and the command it is running.
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// runWithShutdown runs command. Windows has no process groups to signal, so
+// Ctrl-C reaches the command through the console as before.
+func runWithShutdown(command *exec.Cmd) error {
+	return command.Run()
+}
+
+// catchBrokenPipe does nothing, as windows has no SIGPIPE.
+func catchBrokenPipe() {}
@@ -24,3 +24,10 @@ teardown() {
   run ./ahoy init
   [ "${lines[-1]}" == "example.ahoy.yml downloaded to the current directory. You can customize it to suit your needs!" ]
 }
+
+@test "run ahoy init with an output path in a new directory" {
+  run ./ahoy init -o tmp-init/nested/.ahoy.yml
+  [ "${lines[-1]}" == "example.ahoy.yml downloaded to tmp-init/nested/.ahoy.yml. You can customize it to suit your needs!" ]
+  [ -f tmp-init/nested/.ahoy.yml ]
+  rm -rf tmp-init
+}
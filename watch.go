@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/ahoy-cli/ahoy/config"
+)
+
+// watchInterval is how often --watch checks the watched files for changes.
+var watchInterval = 500 * time.Millisecond
+
+// runWatch runs a command, then runs it again each time a file matching its
+// Watch globs, or its Inputs when Watch isn't set, changes. Changes are
+// debounced until the files stop changing for one watchInterval. It keeps
+// going until ahoy is interrupted.
+func runWatch(cmd config.ResolvedCommand, name string, args []string) error {
+	patterns := cmd.Watch
+	if len(patterns) == 0 {
+		patterns = cmd.Inputs
+	}
+	if len(patterns) == 0 {
+		err := errors.New("Command [" + cmd.Name + "] has no files to watch. Set 'watch' to the files that should rerun it.")
+		logger("error", err.Error())
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+	defer signal.Stop(signals)
+
+	snapshot, err := watchSnapshot(patterns)
+	if err != nil {
+		return err
+	}
+	for {
+		// A failing run is reported by the command itself, and the next
+		// change gets another go.
+		if err := runCommand(cmd, name, args); errors.Is(err, errInterrupted) {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "==> watching %s for changes\n", strings.Join(patterns, ", "))
+
+		changed := false
+		for {
+			select {
+			case <-signals:
+				return errInterrupted
+			case <-time.After(watchInterval):
+			}
+			next, err := watchSnapshot(patterns)
+			if err != nil {
+				return err
+			}
+			if sameSnapshot(snapshot, next) {
+				if changed {
+					break
+				}
+				continue
+			}
+			snapshot, changed = next, true
+		}
+		fmt.Fprintf(os.Stderr, "==> change detected, rerunning %s\n", cmd.Name)
+	}
+}
+
+// watchSnapshot returns the modification time of each file matching
+// patterns.
+func watchSnapshot(patterns []string) (map[string]time.Time, error) {
+	snapshot := map[string]time.Time{}
+	for _, pattern := range patterns {
+		files, err := globFiles(AhoyConf.srcDir, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				snapshot[file] = info.ModTime()
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// sameSnapshot reports whether no watched files were added, removed or
+// modified between snapshots a and b.
+func sameSnapshot(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, modTime := range a {
+		if other, ok := b[file]; !ok || !other.Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}